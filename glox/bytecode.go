@@ -0,0 +1,248 @@
+package glox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// BYTECODE_VERSION changes whenever the instruction set or the encoding
+// below does, so stale .loxc files are rejected instead of misread.
+const BYTECODE_VERSION = 3
+
+// bytecodeMagic starts with a DEL byte, which can't begin Lox source, so no
+// script is ever mistaken for bytecode.
+var bytecodeMagic = []byte("\x7fLOXC")
+
+var ErrBytecodeVersion = errors.New("bytecode version mismatch")
+
+const (
+	tagNil byte = iota
+	tagFalse
+	tagTrue
+	tagNumber
+	tagString
+	tagFunction
+)
+
+// IsBytecode reports whether data starts like the output of MarshalBinary.
+func IsBytecode(data []byte) bool {
+	return bytes.HasPrefix(data, bytecodeMagic)
+}
+
+// MarshalBinary encodes the chunk, its line and span tables and its constant
+// pool, including the chunks of nested functions, behind a versioned header.
+func (c *Chunk) MarshalBinary() ([]byte, error) {
+	data := append([]byte(nil), bytecodeMagic...)
+	data = binary.BigEndian.AppendUint16(data, BYTECODE_VERSION)
+	return appendChunk(data, c)
+}
+
+// UnmarshalBinary replaces c with the chunk encoded in data. Strings in the
+// constant pool are not interned until the chunk is handed to a VM.
+func (c *Chunk) UnmarshalBinary(data []byte) error {
+	if !IsBytecode(data) {
+		return errors.New("not a glox bytecode file")
+	}
+
+	reader := &bytecodeReader{data: data[len(bytecodeMagic):]}
+	version := binary.BigEndian.Uint16(reader.bytes(2))
+	if reader.err != nil {
+		return reader.err
+	}
+	if version != BYTECODE_VERSION {
+		return fmt.Errorf("%w: file has version %d, this glox reads version %d", ErrBytecodeVersion, version, BYTECODE_VERSION)
+	}
+
+	reader.chunk(c)
+	if reader.err == nil && len(reader.data) > 0 {
+		reader.fail("trailing data")
+	}
+	return reader.err
+}
+
+func appendChunk(data []byte, c *Chunk) ([]byte, error) {
+	data = binary.AppendUvarint(data, uint64(c.Count))
+	if c.Count > 0 {
+		data = append(data, (*c.Code)[:c.Count]...)
+	}
+
+	data = binary.AppendUvarint(data, uint64(len(c.Lines)))
+	for _, run := range c.Lines {
+		data = binary.AppendUvarint(data, uint64(run.Offset))
+		data = binary.AppendUvarint(data, uint64(run.Line))
+	}
+
+	data = binary.AppendUvarint(data, uint64(len(c.Spans)))
+	for _, run := range c.Spans {
+		data = binary.AppendUvarint(data, uint64(run.Offset))
+		data = binary.AppendUvarint(data, uint64(run.Span.Offset))
+		data = binary.AppendUvarint(data, uint64(run.Span.Length))
+		data = binary.AppendUvarint(data, uint64(run.Span.Line))
+		data = binary.AppendUvarint(data, uint64(run.Span.Column))
+	}
+
+	data = binary.AppendUvarint(data, uint64(c.Constants.Count))
+	for i := 0; i < c.Constants.Count; i++ {
+		var err error
+		data, err = appendConstant(data, (*c.Constants.Values)[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+func appendConstant(data []byte, value Value) ([]byte, error) {
+	switch value.Type {
+	case VAL_NIL:
+		return append(data, tagNil), nil
+	case VAL_BOOL:
+		if value.AsBool() {
+			return append(data, tagTrue), nil
+		}
+		return append(data, tagFalse), nil
+	case VAL_NUMBER:
+		data = append(data, tagNumber)
+		return binary.BigEndian.AppendUint64(data, math.Float64bits(value.AsNumber())), nil
+	}
+
+	switch object := value.AsObj().(type) {
+	case *ObjString:
+		data = append(data, tagString)
+		return appendString(data, object), nil
+	case *ObjFunction:
+		data = append(data, tagFunction)
+		data = binary.AppendUvarint(data, uint64(object.Arity))
+		data = binary.AppendUvarint(data, uint64(object.UpvalueCount))
+		if object.Name == nil {
+			data = append(data, 0)
+		} else {
+			data = append(data, 1)
+			data = appendString(data, object.Name)
+		}
+		return appendChunk(data, &object.Chunk)
+	default:
+		return nil, fmt.Errorf("cannot serialize constant of object type %d", object.GetObjType())
+	}
+}
+
+func appendString(data []byte, str *ObjString) []byte {
+	data = binary.AppendUvarint(data, uint64(len(str.Chars)))
+	return append(data, str.Chars...)
+}
+
+// bytecodeReader decodes the format written by appendChunk. After the first
+// failure every read returns zero values and err holds the cause.
+type bytecodeReader struct {
+	data []byte
+	err  error
+}
+
+func (reader *bytecodeReader) fail(message string) {
+	if reader.err == nil {
+		reader.err = fmt.Errorf("malformed bytecode: %s", message)
+	}
+	reader.data = nil
+}
+
+func (reader *bytecodeReader) bytes(n int) []byte {
+	if reader.err != nil || n > len(reader.data) {
+		reader.fail("unexpected end of data")
+		return make([]byte, n)
+	}
+	data := reader.data[:n]
+	reader.data = reader.data[n:]
+	return data
+}
+
+func (reader *bytecodeReader) byte() byte {
+	return reader.bytes(1)[0]
+}
+
+func (reader *bytecodeReader) uvarint() int {
+	if reader.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(reader.data)
+	if n <= 0 || value > math.MaxInt32 {
+		reader.fail("bad integer")
+		return 0
+	}
+	reader.data = reader.data[n:]
+	return int(value)
+}
+
+// length reads a count of items that each take at least one byte, so a
+// corrupt count can't make us allocate more than the input could hold.
+func (reader *bytecodeReader) length() int {
+	n := reader.uvarint()
+	if n > len(reader.data) {
+		reader.fail("length out of range")
+		return 0
+	}
+	return n
+}
+
+func (reader *bytecodeReader) chunk(c *Chunk) {
+	c.Init()
+
+	c.Count = reader.length()
+	c.Capacity = c.Count
+	code := append([]byte(nil), reader.bytes(c.Count)...)
+	c.Code = &code
+
+	c.Lines = make([]LineRun, reader.length())
+	for i := range c.Lines {
+		c.Lines[i].Offset = reader.uvarint()
+		c.Lines[i].Line = reader.uvarint()
+	}
+
+	c.Spans = make([]spanRun, reader.length())
+	for i := range c.Spans {
+		c.Spans[i].Offset = reader.uvarint()
+		c.Spans[i].Span.Offset = reader.uvarint()
+		c.Spans[i].Span.Length = reader.uvarint()
+		c.Spans[i].Span.Line = reader.uvarint()
+		c.Spans[i].Span.Column = reader.uvarint()
+	}
+
+	count := reader.length()
+	for i := 0; i < count && reader.err == nil; i++ {
+		c.Constants.Write(reader.constant())
+	}
+}
+
+func (reader *bytecodeReader) constant() Value {
+	switch reader.byte() {
+	case tagNil:
+		return NewNilVal()
+	case tagFalse:
+		return NewBoolVal(false)
+	case tagTrue:
+		return NewBoolVal(true)
+	case tagNumber:
+		return NewNumberVal(math.Float64frombits(binary.BigEndian.Uint64(reader.bytes(8))))
+	case tagString:
+		return NewObjVal(reader.string())
+	case tagFunction:
+		function := NewObjFunction()
+		function.Arity = reader.uvarint()
+		function.UpvalueCount = reader.uvarint()
+		if reader.byte() == 1 {
+			function.Name = reader.string()
+		}
+		reader.chunk(&function.Chunk)
+		return NewObjVal(function)
+	default:
+		reader.fail("unknown constant tag")
+		return NewNilVal()
+	}
+}
+
+func (reader *bytecodeReader) string() *ObjString {
+	return NewObjString(string(reader.bytes(reader.length())))
+}
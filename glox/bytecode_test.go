@@ -0,0 +1,186 @@
+package glox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+)
+
+const roundTripSource = `
+var greeting = "hello";
+print greeting + ", world";
+print -0;
+print 0 / 0;
+print 1 / -0;
+var tenth = 0.1;
+print tenth + 0.2;
+
+fun makeCounter(step) {
+  var count = 0;
+  fun next() {
+    count = count + step;
+    return count;
+  }
+  return next;
+}
+var counter = makeCounter(2);
+counter();
+print counter();
+
+class Animal {
+  init(name) { this.name = name; }
+  speak() { return this.name + " makes a sound"; }
+}
+class Dog < Animal {
+  speak() { return super.speak() + ": woof"; }
+}
+print Dog("rex").speak();
+
+for (var i = 0; i < 3; i = i + 1) {
+  if (i == 1) print "one"; else print i;
+}
+`
+
+// compileScript compiles source into a script function the test owns.
+func compileScript(t *testing.T, source string) *ObjFunction {
+	t.Helper()
+
+	vm := NewVM()
+	vm.Init()
+	defer vm.Free()
+
+	function, errs := vm.Compile(source)
+	if errs != nil {
+		t.Fatalf("Compile(%q) failed: %v", source, CompileErrors(errs))
+	}
+	return function
+}
+
+func show(value Value) string {
+	var out bytes.Buffer
+	PrintValue(&out, value)
+	return out.String()
+}
+
+// sameConstants checks that two functions and their constant pools match,
+// comparing numbers bit for bit so -0 and NaN count.
+func sameConstants(t *testing.T, got, want *ObjFunction) {
+	t.Helper()
+
+	if got.Arity != want.Arity || got.UpvalueCount != want.UpvalueCount || functionName(got) != functionName(want) {
+		t.Errorf("function %s/%d/%d, want %s/%d/%d", functionName(got), got.Arity, got.UpvalueCount,
+			functionName(want), want.Arity, want.UpvalueCount)
+	}
+	if got.Chunk.Constants.Count != want.Chunk.Constants.Count {
+		t.Fatalf("%s has %d constants, want %d", functionName(got), got.Chunk.Constants.Count, want.Chunk.Constants.Count)
+	}
+
+	for i := 0; i < want.Chunk.Constants.Count; i++ {
+		g := (*got.Chunk.Constants.Values)[i]
+		w := (*want.Chunk.Constants.Values)[i]
+		switch {
+		case w.IsNumber():
+			if !g.IsNumber() || math.Float64bits(g.AsNumber()) != math.Float64bits(w.AsNumber()) {
+				t.Errorf("%s constant %d = %s, want %s", functionName(want), i, show(g), show(w))
+			}
+		case w.IsFunction():
+			if !g.IsFunction() {
+				t.Fatalf("%s constant %d is not a function", functionName(want), i)
+			}
+			sameConstants(t, g.AsFunction(), w.AsFunction())
+		case w.IsString():
+			if !g.IsString() || string(g.AsString().Chars) != string(w.AsString().Chars) {
+				t.Errorf("%s constant %d = %s, want %s", functionName(want), i, show(g), show(w))
+			}
+		default:
+			if !g.IsEqual(w) {
+				t.Errorf("%s constant %d = %s, want %s", functionName(want), i, show(g), show(w))
+			}
+		}
+	}
+}
+
+func TestBytecodeRoundTrip(t *testing.T) {
+	function := compileScript(t, roundTripSource)
+	data, err := function.Chunk.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+	if !IsBytecode(data) {
+		t.Fatalf("IsBytecode(MarshalBinary()) = false")
+	}
+
+	loaded := NewObjFunction()
+	if err := loaded.Chunk.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %v", err)
+	}
+	if err := Verify(&loaded.Chunk); err != nil {
+		t.Fatalf("Verify failed on the loaded chunk: %v", err)
+	}
+
+	if got, want := disassembleFunction(loaded), disassembleFunction(function); got != want {
+		t.Errorf("disassembly after the round trip =\n%s\nwant\n%s", got, want)
+	}
+	sameConstants(t, loaded, function)
+
+	var fromSource, fromBytecode bytes.Buffer
+	if _, err := Interpret(roundTripSource, WithStdout(&fromSource)); err != nil {
+		t.Fatalf("Interpret failed: %v", err)
+	}
+	if _, err := InterpretBytecode(data, WithStdout(&fromBytecode)); err != nil {
+		t.Fatalf("InterpretBytecode failed: %v", err)
+	}
+	want := "hello, world\n-0\nNaN\n-Inf\n0.30000000000000004\n4\nrex makes a sound: woof\n0\none\n2\n"
+	if fromSource.String() != want {
+		t.Errorf("source printed %q, want %q", fromSource.String(), want)
+	}
+	if fromBytecode.String() != fromSource.String() {
+		t.Errorf("bytecode printed\n%s\nsource printed\n%s", fromBytecode.String(), fromSource.String())
+	}
+}
+
+func TestUnmarshalBinaryErrors(t *testing.T) {
+	function := compileScript(t, roundTripSource)
+	data, err := function.Chunk.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+
+	t.Run("version mismatch", func(t *testing.T) {
+		stale := append([]byte(nil), data...)
+		binary.BigEndian.PutUint16(stale[len(bytecodeMagic):], BYTECODE_VERSION+1)
+
+		var chunk Chunk
+		if err := chunk.UnmarshalBinary(stale); !errors.Is(err, ErrBytecodeVersion) {
+			t.Errorf("UnmarshalBinary() = %v, want ErrBytecodeVersion", err)
+		}
+		if _, err := InterpretBytecode(stale); !errors.Is(err, ErrBytecodeVersion) {
+			t.Errorf("InterpretBytecode() = %v, want ErrBytecodeVersion", err)
+		}
+	})
+
+	t.Run("not bytecode", func(t *testing.T) {
+		var chunk Chunk
+		if err := chunk.UnmarshalBinary([]byte("LOXCount = 3;")); err == nil {
+			t.Errorf("UnmarshalBinary(source) succeeded")
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		for n := len(bytecodeMagic); n < len(data); n++ {
+			var chunk Chunk
+			if err := chunk.UnmarshalBinary(data[:n]); err == nil {
+				t.Fatalf("UnmarshalBinary of the first %d of %d bytes succeeded", n, len(data))
+			}
+		}
+	})
+
+	t.Run("trailing data", func(t *testing.T) {
+		var chunk Chunk
+		if err := chunk.UnmarshalBinary(append(append([]byte(nil), data...), 0)); err == nil {
+			t.Errorf("UnmarshalBinary with a trailing byte succeeded")
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package glox
+
+import "fmt"
+
+// CallError reports a call made from Go through VM.Call that could not be
+// started. Failures while the callee runs are returned as *RuntimeError.
+type CallError struct {
+	Function string
+	Message  string
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Function, e.Message)
+}
+
+// Call looks up the global name and calls it with args, returning the value
+// the callee returned. The VM stays usable after both success and failure.
+func (vm *VM) Call(name string, args ...Value) (Value, error) {
+	callee, found := vm.globals.Get(vm.copyString(name))
+	if !found {
+		return NewNilVal(), &CallError{
+			Function: name,
+			Message:  fmt.Sprintf("Undefined variable '%s'.", name),
+		}
+	}
+
+	return vm.callFromHost(name, callee, args)
+}
+
+// CallValue calls a closure, bound method, class or native value with args.
+func (vm *VM) CallValue(callee Value, args ...Value) (Value, error) {
+	var name string
+	switch {
+	case callee.IsClosure():
+		name = functionName(callee.AsClosure().Function)
+	case callee.IsBoundMethod():
+		name = functionName(callee.AsBoundMethod().Method.Function)
+	case callee.IsClass():
+		name = string(callee.AsClass().Name.Chars)
+	case callee.IsNative():
+		name = string(callee.AsNative().Name.Chars)
+	}
+
+	return vm.callFromHost(name, callee, args)
+}
+
+func functionName(function *ObjFunction) string {
+	if function.Name == nil {
+		return "script"
+	}
+	return string(function.Name.Chars)
+}
+
+func (vm *VM) callFromHost(name string, callee Value, args []Value) (Value, error) {
+	baseFrame := vm.frameCount
+	baseTop := vm.stackTop
+
+	if vm.stackTop+len(args)+1 > STACK_MAX {
+		return NewNilVal(), &CallError{Function: name, Message: "Stack overflow."}
+	}
+
+	callee, err := vm.adopt(callee)
+	if err != nil {
+		return NewNilVal(), &CallError{Function: name, Message: err.Error()}
+	}
+	vm.Push(callee)
+	for _, arg := range args {
+		arg, err := vm.adopt(arg)
+		if err != nil {
+			vm.stackTop = baseTop
+			return NewNilVal(), &CallError{Function: name, Message: err.Error()}
+		}
+		vm.Push(arg)
+	}
+
+	if !vm.callValue(callee, len(args)) {
+		vm.unwind(baseFrame, baseTop)
+		return NewNilVal(), vm.lastError
+	}
+
+	// Natives and classes without an initializer complete inside callValue.
+	if vm.frameCount > baseFrame {
+		if vm.run(baseFrame) != INTERPRET_OK {
+			vm.unwind(baseFrame, baseTop)
+			return NewNilVal(), vm.lastError
+		}
+	}
+
+	result := vm.Pop()
+	vm.stackTop = baseTop
+	return result, nil
+}
+
+// unwind discards everything a failed host call left above the given frame
+// and stack depth.
+func (vm *VM) unwind(baseFrame int, baseTop int) {
+	vm.closeUpvalues(baseTop)
+	vm.frameCount = baseFrame
+	vm.stackTop = baseTop
+}
+
+// SetGlobal defines or replaces the global variable name, e.g. to expose a
+// value built with FromGo to scripts. Values the VM can't run safely,
+// including objects other than strings that belong to another VM, are
+// rejected and leave the global unchanged.
+func (vm *VM) SetGlobal(name string, value Value) error {
+	vm.Push(NewObjVal(vm.copyString(name)))
+	value, err := vm.adopt(value)
+	if err != nil {
+		vm.Pop()
+		return err
+	}
+	vm.Push(value)
+	vm.globals.Set(vm.Peek(1).AsString(), vm.Peek(0))
+	vm.Pop()
+	vm.Pop()
+	return nil
+}
+
+// GetGlobal returns the value of the global variable name.
+func (vm *VM) GetGlobal(name string) (Value, bool) {
+	return vm.globals.Get(vm.copyString(name))
+}
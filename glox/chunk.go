@@ -2,7 +2,7 @@ package glox
 
 const (
 	OP_RETURN byte = iota
-	OP_CONSTANT_LONG
+	OP_CONSTANT
 	OP_NIL
 	OP_TRUE
 	OP_FALSE
@@ -19,20 +19,56 @@ const (
 	OP_POP
 	OP_DEFINE_GLOBAL
 	OP_GET_GLOBAL
+	OP_SET_GLOBAL
+	OP_GET_LOCAL
+	OP_SET_LOCAL
+	OP_JUMP
+	OP_JUMP_IF_FALSE
+	OP_LOOP
+	OP_CALL
+	OP_CLOSURE
+	OP_GET_UPVALUE
+	OP_SET_UPVALUE
+	OP_CLOSE_UPVALUE
+	OP_CLASS
+	OP_GET_PROPERTY
+	OP_SET_PROPERTY
+	OP_METHOD
+	OP_INVOKE
+	OP_INHERIT
+	OP_GET_SUPER
+	OP_SUPER_INVOKE
+	// OP_WIDE and OP_EXTRA_WIDE widen the first operand of the instruction
+	// that follows them to 16 and 24 bits.
+	OP_WIDE
+	OP_EXTRA_WIDE
 )
 
-type line struct {
-	Value int
-	Count int
+// LineRun says that the bytes from Offset up to the next run's Offset were
+// compiled from source line Line.
+type LineRun struct {
+	Offset int
+	Line   int
+}
+
+// spanRun is like LineRun, for spans.
+type spanRun struct {
+	Offset int
+	Span   Span
 }
 
 type Chunk struct {
 	Count    int
 	Capacity int
 	Code     *[]byte
-	// This is a incredibly bad idea, but I'm going to do it anyway
-	Lines     *[]line
+	// Lines and Spans are run-length encoded and sorted by Offset.
+	Lines     []LineRun
+	Spans     []spanRun
 	Constants valueArray
+	// constantIndex finds existing constants so AddConstant can reuse them.
+	constantIndex map[constantKey]int
+	// source is the text the chunk was compiled from, used to render errors.
+	source string
 }
 
 func NewChunk() *Chunk {
@@ -48,22 +84,36 @@ func (c *Chunk) Init() {
 	c.Capacity = 0
 	c.Code = nil
 	c.Lines = nil
+	c.Spans = nil
+	c.constantIndex = nil
+	c.source = ""
 	c.Constants.Init()
 }
 
-func (c *Chunk) Write(Byte byte, Line int) {
+func (c *Chunk) Write(Byte byte, span Span) {
 	if c.Capacity < c.Count+1 {
 		c.Capacity = GROW_CAPACITY(c.Capacity)
 		c.Code = GROW_ARRAY(c.Code, c.Capacity)
-		c.Lines = GROW_ARRAY(c.Lines, c.Capacity)
 	}
 
 	(*c.Code)[c.Count] = Byte
-	c.WriteLine(Line)
+	c.WriteLine(span.Line)
+	c.WriteSpan(span)
 
 	c.Count += 1
 }
 
+// truncate drops the code from offset count on.
+func (c *Chunk) truncate(count int) {
+	c.Count = count
+	for len(c.Lines) > 0 && c.Lines[len(c.Lines)-1].Offset >= count {
+		c.Lines = c.Lines[:len(c.Lines)-1]
+	}
+	for len(c.Spans) > 0 && c.Spans[len(c.Spans)-1].Offset >= count {
+		c.Spans = c.Spans[:len(c.Spans)-1]
+	}
+}
+
 func (c *Chunk) Free() {
 	c.Init()
 	c.Constants.Free()
@@ -1,60 +1,157 @@
 package glox
 
-func SplitConstant(value int) (byte, byte, byte) {
-	constant0 := byte(value >> 16)
-	constant1 := byte(value >> 8)
-	constant2 := byte(value)
+import (
+	"math"
+	"sort"
+)
 
-	return constant0, constant1, constant2
+// SplitConstant splits value into width big-endian operand bytes.
+func SplitConstant(value int, width int) []byte {
+	operand := make([]byte, width)
+	for i := width - 1; i >= 0; i-- {
+		operand[i] = byte(value)
+		value >>= 8
+	}
+	return operand
+}
+
+// OperandWidth returns how many bytes, one to three, value needs as an
+// operand.
+func OperandWidth(value int) int {
+	switch {
+	case value <= math.MaxUint8:
+		return 1
+	case value <= math.MaxUint16:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// constantKey identifies a constant. Numbers compare by their bits, so 0 and
+// -0 stay apart and NaN matches itself.
+type constantKey struct {
+	Type ValueType
+	bits uint64
+	obj  Obj
+}
+
+func keyOf(value Value) constantKey {
+	key := constantKey{Type: value.Type}
+	switch value.Type {
+	case VAL_BOOL:
+		if value.AsBool() {
+			key.bits = 1
+		}
+	case VAL_NUMBER:
+		key.bits = math.Float64bits(value.AsNumber())
+	case VAL_OBJ:
+		key.obj = value.AsObj()
+	}
+	return key
 }
 
+// AddConstant returns the index of value in the constant pool, adding it
+// only if an identical constant isn't there already.
 func (c *Chunk) AddConstant(value Value) int {
+	key := keyOf(value)
+	if index, ok := c.constantIndex[key]; ok {
+		return index
+	}
+
 	c.Constants.Write(value)
+	if c.constantIndex == nil {
+		c.constantIndex = make(map[constantKey]int)
+	}
+	c.constantIndex[key] = c.Constants.Count - 1
 	return c.Constants.Count - 1
 }
 
-func (c *Chunk) WriteConstant(value Value, Line int) {
-	c.Write(OP_CONSTANT_LONG, Line)
-	constant := c.AddConstant(value)
-	constant0, constant1, constant2 := SplitConstant(constant)
-	c.Write(byte(constant0), Line)
-	c.Write(byte(constant1), Line)
-	c.Write(byte(constant2), Line)
+// popConstant removes the last constant in the pool. Nothing in the chunk may
+// refer to it any more.
+func (c *Chunk) popConstant() {
+	last := &(*c.Constants.Values)[c.Constants.Count-1]
+	delete(c.constantIndex, keyOf(*last))
+	*last = NewNilVal()
+	c.Constants.Count--
 }
 
-func (c *Chunk) ReadConstant(offset int) int {
-	constant0 := (*c.Code)[offset]
-	constant1 := (*c.Code)[offset+1]
-	constant2 := (*c.Code)[offset+2]
+func (c *Chunk) WriteConstant(value Value, span Span) {
+	c.WriteOperand(OP_CONSTANT, c.AddConstant(value), span)
+}
 
-	constant := int(constant0)<<16 | int(constant1)<<8 | int(constant2)
+// WriteOperand writes instruction followed by operand, behind OP_WIDE or
+// OP_EXTRA_WIDE when the operand doesn't fit in one byte.
+func (c *Chunk) WriteOperand(instruction byte, operand int, span Span) {
+	width := OperandWidth(operand)
+	switch width {
+	case 2:
+		c.Write(OP_WIDE, span)
+	case 3:
+		c.Write(OP_EXTRA_WIDE, span)
+	}
+
+	c.Write(instruction, span)
+	for _, Byte := range SplitConstant(operand, width) {
+		c.Write(Byte, span)
+	}
+}
+
+// ReadConstant reads the width-byte operand at offset.
+func (c *Chunk) ReadConstant(offset int, width int) int {
+	constant := 0
+	for i := 0; i < width; i++ {
+		constant = constant<<8 | int((*c.Code)[offset+i])
+	}
 	return constant
 }
 
+// GetLine returns the source line of the byte at offset, or -1 if the chunk
+// has no line for it.
 func (c *Chunk) GetLine(offset int) int {
-	line := 0
-	for i := 0; i < len(*c.Lines); i++ {
-		line += (*c.Lines)[i].Count
-		if line > offset {
-			return (*c.Lines)[i].Value
-		}
+	if offset < 0 || offset >= c.Count {
+		return -1
+	}
+
+	// Find the last run starting at or before offset.
+	i := sort.Search(len(c.Lines), func(i int) bool { return c.Lines[i].Offset > offset })
+	if i == 0 {
+		return -1
 	}
-	return -1
+	return c.Lines[i-1].Line
 }
 
+// WriteLine records that the byte at c.Count came from line Line.
 func (c *Chunk) WriteLine(Line int) {
-	linesLen := len(*c.Lines)
-	if linesLen == 0 {
-		(*c.Lines)[c.Count] = line{
-			Value: Line,
-			Count: 1,
-		}
-	} else if (*c.Lines)[c.Count].Value == Line {
-		(*c.Lines)[c.Count].Count += 1
-	} else {
-		(*c.Lines)[c.Count] = line{
-			Value: Line,
-			Count: 1,
-		}
+	if last := len(c.Lines) - 1; last >= 0 && c.Lines[last].Line == Line {
+		return
+	}
+	c.Lines = append(c.Lines, LineRun{Offset: c.Count, Line: Line})
+}
+
+// LineTable returns a copy of the chunk's run-length line table.
+func (c *Chunk) LineTable() []LineRun {
+	return append([]LineRun(nil), c.Lines...)
+}
+
+// GetSpan returns the source span of the byte at offset, or the zero Span if
+// the chunk has none.
+func (c *Chunk) GetSpan(offset int) Span {
+	if offset < 0 || offset >= c.Count {
+		return Span{}
+	}
+
+	i := sort.Search(len(c.Spans), func(i int) bool { return c.Spans[i].Offset > offset })
+	if i == 0 {
+		return Span{}
+	}
+	return c.Spans[i-1].Span
+}
+
+// WriteSpan records that the byte at c.Count came from span.
+func (c *Chunk) WriteSpan(span Span) {
+	if last := len(c.Spans) - 1; last >= 0 && c.Spans[last].Span == span {
+		return
 	}
+	c.Spans = append(c.Spans, spanRun{Offset: c.Count, Span: span})
 }
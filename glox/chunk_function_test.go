@@ -0,0 +1,122 @@
+package glox
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// chunkWithLines builds a chunk of OP_NIL instructions, one per entry in
+// lines, each attributed to that line.
+func chunkWithLines(lines []int) *Chunk {
+	chunk := &Chunk{}
+	chunk.Init()
+	for _, line := range lines {
+		chunk.Write(OP_NIL, Span{Line: line})
+	}
+	return chunk
+}
+
+func TestLineTable(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []int
+		want  []LineRun
+	}{
+		{"empty", nil, nil},
+		{"one line", []int{1, 1, 1}, []LineRun{{0, 1}}},
+		{"runs", []int{1, 1, 2, 2, 2, 5}, []LineRun{{0, 1}, {2, 2}, {5, 5}}},
+		{"back to an earlier line", []int{3, 4, 3}, []LineRun{{0, 3}, {1, 4}, {2, 3}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunk := chunkWithLines(test.lines)
+			if got := chunk.LineTable(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("LineTable() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLineTableIsACopy(t *testing.T) {
+	chunk := chunkWithLines([]int{1, 2})
+	chunk.LineTable()[0].Line = 99
+	if line := chunk.GetLine(0); line != 1 {
+		t.Errorf("GetLine(0) = %d after editing LineTable's result, want 1", line)
+	}
+}
+
+func TestGetLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []int
+	}{
+		{"one line", []int{7}},
+		{"runs", []int{1, 1, 2, 2, 2, 5}},
+		{"back to an earlier line", []int{3, 4, 3, 3}},
+		{"every byte a new line", []int{1, 2, 3, 4, 5, 6, 7, 8}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunk := chunkWithLines(test.lines)
+			for offset, want := range test.lines {
+				if got := chunk.GetLine(offset); got != want {
+					t.Errorf("GetLine(%d) = %d, want %d", offset, got, want)
+				}
+			}
+			for _, offset := range []int{-1, len(test.lines)} {
+				if got := chunk.GetLine(offset); got != -1 {
+					t.Errorf("GetLine(%d) = %d, want -1", offset, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDisassembleChunkLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []int
+		want  string
+	}{
+		{
+			"one line",
+			[]int{1, 1},
+			"== test ==\n" +
+				"0000    1 OP_NIL\n" +
+				"0001    | OP_NIL\n" +
+				"   2    | OP_DONE\n",
+		},
+		{
+			"new line per run",
+			[]int{1, 2, 2, 10},
+			"== test ==\n" +
+				"0000    1 OP_NIL\n" +
+				"0001    2 OP_NIL\n" +
+				"0002    | OP_NIL\n" +
+				"0003   10 OP_NIL\n" +
+				"   4    | OP_DONE\n",
+		},
+		{
+			"back to an earlier line",
+			[]int{3, 4, 3},
+			"== test ==\n" +
+				"0000    3 OP_NIL\n" +
+				"0001    4 OP_NIL\n" +
+				"0002    3 OP_NIL\n" +
+				"   3    | OP_DONE\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			chunkWithLines(test.lines).DisassembleChunk(&out, "test")
+			if got := out.String(); got != test.want {
+				t.Errorf("DisassembleChunk() =\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
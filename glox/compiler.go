@@ -2,7 +2,8 @@ package glox
 
 import (
 	"fmt"
-	"os"
+	"io"
+	"math"
 	"strconv"
 )
 
@@ -22,7 +23,7 @@ const (
 	PREC_PRIMARY
 )
 
-type ParseFn func()
+type ParseFn func(compiler *Compiler, canAssign bool)
 
 type ParseRule struct {
 	prefix     ParseFn
@@ -34,42 +35,42 @@ var rules map[TokenType]ParseRule
 
 func init() {
 	rules = map[TokenType]ParseRule{
-		TOKEN_LEFT_PAREN:    {prefix: compiler.grouping, infix: nil, precedence: PREC_NONE},
+		TOKEN_LEFT_PAREN:    {prefix: (*Compiler).grouping, infix: (*Compiler).call, precedence: PREC_CALL},
 		TOKEN_RIGHT_PAREN:   {prefix: nil, infix: nil, precedence: PREC_NONE},
 		TOKEN_LEFT_BRACE:    {prefix: nil, infix: nil, precedence: PREC_NONE},
 		TOKEN_RIGHT_BRACE:   {prefix: nil, infix: nil, precedence: PREC_NONE},
 		TOKEN_COMMA:         {prefix: nil, infix: nil, precedence: PREC_NONE},
-		TOKEN_DOT:           {prefix: nil, infix: nil, precedence: PREC_NONE},
-		TOKEN_MINUS:         {prefix: compiler.unary, infix: compiler.binary, precedence: PREC_TERM},
-		TOKEN_PLUS:          {prefix: nil, infix: compiler.binary, precedence: PREC_TERM},
+		TOKEN_DOT:           {prefix: nil, infix: (*Compiler).dot, precedence: PREC_CALL},
+		TOKEN_MINUS:         {prefix: (*Compiler).unary, infix: (*Compiler).binary, precedence: PREC_TERM},
+		TOKEN_PLUS:          {prefix: nil, infix: (*Compiler).binary, precedence: PREC_TERM},
 		TOKEN_SEMICOLON:     {prefix: nil, infix: nil, precedence: PREC_NONE},
-		TOKEN_SLASH:         {prefix: nil, infix: compiler.binary, precedence: PREC_FACTOR},
-		TOKEN_STAR:          {prefix: nil, infix: compiler.binary, precedence: PREC_FACTOR},
-		TOKEN_BANG:          {prefix: compiler.unary, infix: nil, precedence: PREC_NONE},
-		TOKEN_BANG_EQUAL:    {prefix: nil, infix: compiler.binary, precedence: PREC_EQUALITY},
+		TOKEN_SLASH:         {prefix: nil, infix: (*Compiler).binary, precedence: PREC_FACTOR},
+		TOKEN_STAR:          {prefix: nil, infix: (*Compiler).binary, precedence: PREC_FACTOR},
+		TOKEN_BANG:          {prefix: (*Compiler).unary, infix: nil, precedence: PREC_NONE},
+		TOKEN_BANG_EQUAL:    {prefix: nil, infix: (*Compiler).binary, precedence: PREC_EQUALITY},
 		TOKEN_EQUAL:         {prefix: nil, infix: nil, precedence: PREC_NONE},
-		TOKEN_EQUAL_EQUAL:   {prefix: nil, infix: compiler.binary, precedence: PREC_EQUALITY},
-		TOKEN_GREATER:       {prefix: nil, infix: compiler.binary, precedence: PREC_COMPARISON},
-		TOKEN_GREATER_EQUAL: {prefix: nil, infix: compiler.binary, precedence: PREC_COMPARISON},
-		TOKEN_LESS:          {prefix: nil, infix: compiler.binary, precedence: PREC_COMPARISON},
-		TOKEN_LESS_EQUAL:    {prefix: nil, infix: compiler.binary, precedence: PREC_COMPARISON},
-		TOKEN_IDENTIFIER:    {prefix: compiler.variable, infix: nil, precedence: PREC_NONE},
-		TOKEN_STRING:        {prefix: compiler.string, infix: nil, precedence: PREC_NONE},
-		TOKEN_NUMBER:        {prefix: compiler.number, infix: nil, precedence: PREC_NONE},
-		TOKEN_AND:           {prefix: nil, infix: nil, precedence: PREC_NONE},
+		TOKEN_EQUAL_EQUAL:   {prefix: nil, infix: (*Compiler).binary, precedence: PREC_EQUALITY},
+		TOKEN_GREATER:       {prefix: nil, infix: (*Compiler).binary, precedence: PREC_COMPARISON},
+		TOKEN_GREATER_EQUAL: {prefix: nil, infix: (*Compiler).binary, precedence: PREC_COMPARISON},
+		TOKEN_LESS:          {prefix: nil, infix: (*Compiler).binary, precedence: PREC_COMPARISON},
+		TOKEN_LESS_EQUAL:    {prefix: nil, infix: (*Compiler).binary, precedence: PREC_COMPARISON},
+		TOKEN_IDENTIFIER:    {prefix: (*Compiler).variable, infix: nil, precedence: PREC_NONE},
+		TOKEN_STRING:        {prefix: (*Compiler).string, infix: nil, precedence: PREC_NONE},
+		TOKEN_NUMBER:        {prefix: (*Compiler).number, infix: nil, precedence: PREC_NONE},
+		TOKEN_AND:           {prefix: nil, infix: (*Compiler).and, precedence: PREC_AND},
 		TOKEN_CLASS:         {prefix: nil, infix: nil, precedence: PREC_NONE},
 		TOKEN_ELSE:          {prefix: nil, infix: nil, precedence: PREC_NONE},
-		TOKEN_FALSE:         {prefix: compiler.literal, infix: nil, precedence: PREC_NONE},
+		TOKEN_FALSE:         {prefix: (*Compiler).literal, infix: nil, precedence: PREC_NONE},
 		TOKEN_FOR:           {prefix: nil, infix: nil, precedence: PREC_NONE},
 		TOKEN_FUN:           {prefix: nil, infix: nil, precedence: PREC_NONE},
 		TOKEN_IF:            {prefix: nil, infix: nil, precedence: PREC_NONE},
-		TOKEN_NIL:           {prefix: compiler.literal, infix: nil, precedence: PREC_NONE},
-		TOKEN_OR:            {prefix: nil, infix: nil, precedence: PREC_NONE},
+		TOKEN_NIL:           {prefix: (*Compiler).literal, infix: nil, precedence: PREC_NONE},
+		TOKEN_OR:            {prefix: nil, infix: (*Compiler).or, precedence: PREC_OR},
 		TOKEN_PRINT:         {prefix: nil, infix: nil, precedence: PREC_NONE},
 		TOKEN_RETURN:        {prefix: nil, infix: nil, precedence: PREC_NONE},
-		TOKEN_SUPER:         {prefix: nil, infix: nil, precedence: PREC_NONE},
-		TOKEN_THIS:          {prefix: nil, infix: nil, precedence: PREC_NONE},
-		TOKEN_TRUE:          {prefix: compiler.literal, infix: nil, precedence: PREC_NONE},
+		TOKEN_SUPER:         {prefix: (*Compiler).super, infix: nil, precedence: PREC_NONE},
+		TOKEN_THIS:          {prefix: (*Compiler).this, infix: nil, precedence: PREC_NONE},
+		TOKEN_TRUE:          {prefix: (*Compiler).literal, infix: nil, precedence: PREC_NONE},
 		TOKEN_VAR:           {prefix: nil, infix: nil, precedence: PREC_NONE},
 		TOKEN_WHILE:         {prefix: nil, infix: nil, precedence: PREC_NONE},
 		TOKEN_ERROR:         {prefix: nil, infix: nil, precedence: PREC_NONE},
@@ -81,18 +82,20 @@ func getRule(tokenType TokenType) ParseRule {
 	return rules[tokenType]
 }
 
-func Compile(source string) {
+// Compile writes the tokens scanned from source to w, one per line.
+func Compile(w io.Writer, source string) {
+	scanner := &Scanner{}
 	scanner.initScanner(source)
 	var line int = -1
 	for {
 		token := scanner.scanToken()
 		if token.line != line {
-			fmt.Printf("%4d ", token.line)
+			fmt.Fprintf(w, "%4d ", token.line)
 			line = token.line
 		} else {
-			fmt.Printf("   | ")
+			fmt.Fprintf(w, "   | ")
 		}
-		fmt.Printf("%2d '%s'\n", token.tokenType, token.value)
+		fmt.Fprintf(w, "%2d '%s'\n", token.tokenType, token.value)
 
 		if token.tokenType == TOKEN_EOF {
 			break
@@ -100,21 +103,114 @@ func Compile(source string) {
 	}
 }
 
+const UINT8_COUNT = 256
+
+type Local struct {
+	name       Token
+	depth      int
+	isCaptured bool
+}
+
+type Upvalue struct {
+	index   byte
+	isLocal bool
+}
+
+type FunctionType byte
+
+const (
+	TYPE_FUNCTION FunctionType = iota
+	TYPE_INITIALIZER
+	TYPE_METHOD
+	TYPE_SCRIPT
+)
+
+type FunctionCompiler struct {
+	enclosing    *FunctionCompiler
+	function     *ObjFunction
+	functionType FunctionType
+	locals       [UINT8_COUNT]Local
+	localCount   int
+	upvalues     [UINT8_COUNT]Upvalue
+	scopeDepth   int
+
+	// literals are the literal pushes at the end of the chunk that an
+	// operator emitted next may fold into its result.
+	literals []literalPush
+	// jumpTarget is the furthest offset a jump lands on. Folding never
+	// rewrites code at or before it.
+	jumpTarget int
+}
+
+type literalPush struct {
+	offset int
+	end    int
+	value  Value
+	// constant is the pool index the push added, or -1 if it added none.
+	constant int
+}
+
+type ClassCompiler struct {
+	enclosing     *ClassCompiler
+	hasSuperclass bool
+}
+
 type Compiler struct {
-	previous      Token
-	current       Token
-	hadError      bool
-	panicMode     bool
-	complierChunk *Chunk
+	previous         Token
+	current          Token
+	hadError         bool
+	panicMode        bool
+	errors           []CompileError
+	functionCompiler *FunctionCompiler
+	classCompiler    *ClassCompiler
+	scanner          *Scanner
+	vm               *VM
+}
+
+func NewCompiler(vm *VM, source string) *Compiler {
+	scanner := &Scanner{}
+	scanner.initScanner(source)
+
+	return &Compiler{
+		scanner: scanner,
+		vm:      vm,
+	}
 }
 
-var compiler Compiler
+func (compiler *Compiler) currentChunk() *Chunk {
+	return &compiler.functionCompiler.function.Chunk
+}
+
+func (compiler *Compiler) beginFunction(functionType FunctionType) {
+	functionCompiler := &FunctionCompiler{
+		enclosing:    compiler.functionCompiler,
+		function:     ALLOCATE_OBJ(compiler.vm, NewObjFunction()),
+		functionType: functionType,
+	}
+	compiler.functionCompiler = functionCompiler
+	functionCompiler.function.Chunk.source = compiler.scanner.source
+
+	if functionType != TYPE_SCRIPT {
+		functionCompiler.function.Name = compiler.vm.copyString(compiler.previous.value)
+	}
+
+	// Slot zero holds the function being called, or the receiver in methods.
+	local := &functionCompiler.locals[functionCompiler.localCount]
+	functionCompiler.localCount += 1
+	local.depth = 0
+	local.isCaptured = false
+	if functionType != TYPE_FUNCTION {
+		local.name.value = "this"
+	} else {
+		local.name.value = ""
+	}
+}
 
 func (compiler *Compiler) advance() {
 	compiler.previous = compiler.current
 
 	for {
-		compiler.current = scanner.scanToken()
+		compiler.current = compiler.scanner.scanToken()
 		if compiler.current.tokenType != TOKEN_ERROR {
 			break
 		}
@@ -136,18 +232,46 @@ func (compiler *Compiler) errorAt(token *Token, message string) {
 		return
 	}
 	compiler.panicMode = true
+	compiler.hadError = true
 
-	fmt.Fprintf(os.Stderr, "[line %d] Error", token.line)
+	compiler.errors = append(compiler.errors, compiler.newCompileError(token, message, SEVERITY_ERROR))
+}
 
-	if token.tokenType == TOKEN_EOF {
-		fmt.Fprintf(os.Stderr, " at end")
-	} else if token.tokenType == TOKEN_ERROR {
-		// Nothing.
+// errorAtOffset reports a function that failed verification at the source
+// the offending instruction came from.
+func (compiler *Compiler) errorAtOffset(err *VerifyError) {
+	span := compiler.currentChunk().GetSpan(err.Offset)
+	token := Token{
+		tokenType: TOKEN_IDENTIFIER,
+		start:     span.Offset,
+		length:    span.Length,
+		line:      span.Line,
+		column:    span.Column,
+	}
+
+	if err.overflow {
+		compiler.errorAt(&token, "Too many values on the stack in function.")
 	} else {
-		fmt.Fprintf(os.Stderr, " at '%s'", token.value)
+		compiler.errorAt(&token, fmt.Sprintf("Generated invalid bytecode: %s.", err.Message))
 	}
+}
 
-	fmt.Fprintf(os.Stderr, ": %s\n", message)
+func (compiler *Compiler) newCompileError(token *Token, message string, severity Severity) CompileError {
+	source := compiler.scanner.source
+
+	err := CompileError{
+		Line:      token.line,
+		Column:    token.column,
+		Offset:    token.start,
+		Message:   message,
+		Severity:  severity,
+		tokenType: token.tokenType,
+		snippet:   renderSpan(source, token.span()),
+	}
+	if token.tokenType != TOKEN_EOF {
+		err.Lexeme = source[token.start : token.start+token.length]
+	}
+	return err
 }
 
 func (compiler *Compiler) check(tokenType TokenType) bool {
@@ -172,46 +296,464 @@ func (compiler *Compiler) consume(tokenType TokenType, message string) {
 }
 
 func (compiler *Compiler) emitByte(Byte byte) {
-	compiler.complierChunk.Write(Byte, compiler.current.line)
+	compiler.emitBytesAt(&compiler.previous, Byte)
 }
 
 func (compiler *Compiler) emitBytes(bytes ...byte) {
+	compiler.emitBytesAt(&compiler.previous, bytes...)
+}
+
+// emitBytesAt attributes bytes to token, so errors raised by them point at
+// it rather than at the last token consumed.
+func (compiler *Compiler) emitBytesAt(token *Token, bytes ...byte) {
 	for _, Byte := range bytes {
-		compiler.complierChunk.Write(Byte, compiler.current.line)
+		compiler.currentChunk().Write(Byte, token.span())
 	}
 }
 
-func (compiler *Compiler) endCompiler() {
-	compiler.emitReturn()
+// emitOperand emits instruction with operand, widened as far as it needs.
+func (compiler *Compiler) emitOperand(instruction byte, operand int) {
+	compiler.emitOperandAt(&compiler.previous, instruction, operand)
+}
+
+func (compiler *Compiler) emitOperandAt(token *Token, instruction byte, operand int) {
+	compiler.currentChunk().WriteOperand(instruction, operand, token.span())
+}
+
+// endCompiler finishes the current function. returns says its body already
+// ends in a return, so the implicit one would be dead code.
+func (compiler *Compiler) endCompiler(returns bool) *ObjFunction {
+	if !returns {
+		compiler.emitReturn()
+	}
+	function := compiler.functionCompiler.function
+
+	// Hold compiled code to the same rules as bytecode loaded from a file,
+	// so everything the compiler accepts can be saved and run again.
+	if !compiler.hadError {
+		if err := verifyFunction(function); err != nil {
+			compiler.errorAtOffset(err.(*VerifyError))
+		}
+	}
+
 	if DEBUG_PRINT_CODE {
 		if !compiler.hadError {
-			compiler.complierChunk.DisassembleChunk("code")
+			name := "<script>"
+			if function.Name != nil {
+				name = string(function.Name.Chars)
+			}
+			compiler.currentChunk().DisassembleChunk(compiler.vm.stderr, name)
 		}
 	}
+
+	compiler.functionCompiler = compiler.functionCompiler.enclosing
+	return function
+}
+
+func (compiler *Compiler) emitJump(instruction byte) int {
+	compiler.emitBytes(instruction, 0xff, 0xff)
+	return compiler.currentChunk().Count - 2
+}
+
+func (compiler *Compiler) patchJump(offset int) {
+	// -2 to adjust for the bytecode for the jump offset itself.
+	jump := compiler.currentChunk().Count - offset - 2
+
+	if jump > math.MaxUint16 {
+		compiler.error("Too much code to jump over.")
+	}
+
+	(*compiler.currentChunk().Code)[offset] = byte(jump >> 8)
+	(*compiler.currentChunk().Code)[offset+1] = byte(jump)
+	compiler.markJumpTarget()
+}
+
+// markJumpTarget records that a jump lands on the current offset and
+// returns it.
+func (compiler *Compiler) markJumpTarget() int {
+	target := compiler.currentChunk().Count
+	compiler.functionCompiler.jumpTarget = target
+	return target
+}
+
+// truncate drops the code from offset count on, along with any literal
+// pushes folding still knew about there and the constants they added.
+func (compiler *Compiler) truncate(count int) {
+	functionCompiler := compiler.functionCompiler
+	chunk := compiler.currentChunk()
+	chunk.truncate(count)
+
+	for len(functionCompiler.literals) > 0 && functionCompiler.literals[len(functionCompiler.literals)-1].end > count {
+		literal := functionCompiler.literals[len(functionCompiler.literals)-1]
+		if literal.constant != -1 && literal.constant == chunk.Constants.Count-1 {
+			chunk.popConstant()
+		}
+		functionCompiler.literals = functionCompiler.literals[:len(functionCompiler.literals)-1]
+	}
+	functionCompiler.jumpTarget = min(functionCompiler.jumpTarget, count)
+}
+
+func (compiler *Compiler) emitLoop(loopStart int) {
+	compiler.emitByte(OP_LOOP)
+
+	offset := compiler.currentChunk().Count - loopStart + 2
+	if offset > math.MaxUint16 {
+		compiler.error("Loop body too large.")
+	}
+
+	compiler.emitBytes(byte(offset>>8), byte(offset))
 }
 
 func (compiler *Compiler) emitReturn() {
+	if compiler.functionCompiler.functionType == TYPE_INITIALIZER {
+		compiler.emitBytes(OP_GET_LOCAL, 0)
+	} else {
+		compiler.emitByte(OP_NIL)
+	}
+
 	compiler.emitByte(OP_RETURN)
 }
 
-func (compiler *Compiler) emitConstant(value Value) {
-	compiler.complierChunk.WriteConstant(value, compiler.previous.line)
+// emitLiteral pushes value and remembers it for folding.
+func (compiler *Compiler) emitLiteral(token *Token, value Value) {
+	offset := compiler.currentChunk().Count
+	constantCount := compiler.currentChunk().Constants.Count
+	literals := compiler.functionCompiler.literals
+	if len(literals) > 0 && literals[len(literals)-1].end != offset {
+		compiler.functionCompiler.literals = literals[:0]
+	}
+
+	switch {
+	case value.IsNil():
+		compiler.emitBytesAt(token, OP_NIL)
+	case value.IsBool() && value.AsBool():
+		compiler.emitBytesAt(token, OP_TRUE)
+	case value.IsBool():
+		compiler.emitBytesAt(token, OP_FALSE)
+	default:
+		compiler.currentChunk().WriteConstant(value, token.span())
+	}
+
+	constant := -1
+	if compiler.currentChunk().Constants.Count > constantCount {
+		constant = constantCount
+	}
+	compiler.functionCompiler.literals = append(compiler.functionCompiler.literals, literalPush{
+		offset:   offset,
+		end:      compiler.currentChunk().Count,
+		value:    value,
+		constant: constant,
+	})
+}
+
+// emitOperation emits an operator instruction, or, when its operands are
+// literals pushed right before it, replaces them with the result.
+func (compiler *Compiler) emitOperation(operator *Token, instruction byte) {
+	functionCompiler := compiler.functionCompiler
+
+	operandCount := 2
+	if instruction == OP_NOT || instruction == OP_NEGATE {
+		operandCount = 1
+	}
+
+	if len(functionCompiler.literals) >= operandCount {
+		operands := functionCompiler.literals[len(functionCompiler.literals)-operandCount:]
+
+		// The operands must be the last thing emitted, with nothing jumping
+		// into the middle of them.
+		end := compiler.currentChunk().Count
+		for i := len(operands) - 1; i >= 0 && end != -1; i-- {
+			if operands[i].end != end {
+				end = -1
+			} else {
+				end = operands[i].offset
+			}
+		}
+
+		if end != -1 && functionCompiler.jumpTarget <= end {
+			if result, ok := compiler.fold(instruction, operands); ok {
+				compiler.truncate(end)
+				compiler.emitLiteral(operator, result)
+				return
+			}
+		}
+	}
+
+	compiler.emitBytesAt(operator, instruction)
+}
+
+// fold evaluates instruction on literal operands exactly as the VM would. It
+// reports false for anything that would be a runtime error.
+func (compiler *Compiler) fold(instruction byte, operands []literalPush) (Value, bool) {
+	a := operands[0].value
+
+	switch instruction {
+	case OP_NOT:
+		return NewBoolVal(compiler.vm.IsFalsy(a)), true
+	case OP_NEGATE:
+		if !a.IsNumber() {
+			return NewNilVal(), false
+		}
+		return NewNumberVal(-a.AsNumber()), true
+	}
+
+	b := operands[1].value
+	if instruction == OP_EQUAL {
+		return NewBoolVal(a.IsEqual(b)), true
+	}
+
+	if instruction == OP_ADD && a.IsString() && b.IsString() {
+		chars := string(a.AsString().Chars) + string(b.AsString().Chars)
+		return NewObjVal(compiler.vm.copyString(chars)), true
+	}
+
+	if !a.IsNumber() || !b.IsNumber() {
+		return NewNilVal(), false
+	}
+
+	switch instruction {
+	case OP_ADD:
+		return NewNumberVal(a.AsNumber() + b.AsNumber()), true
+	case OP_SUBTRACT:
+		return NewNumberVal(a.AsNumber() - b.AsNumber()), true
+	case OP_MULTIPLY:
+		return NewNumberVal(a.AsNumber() * b.AsNumber()), true
+	case OP_DIVIDE:
+		return NewNumberVal(a.AsNumber() / b.AsNumber()), true
+	case OP_GREATER:
+		return NewBoolVal(a.AsNumber() > b.AsNumber()), true
+	case OP_LESS:
+		return NewBoolVal(a.AsNumber() < b.AsNumber()), true
+	}
+	return NewNilVal(), false
 }
 
 func (compiler *Compiler) identifierConstant(token *Token) int {
-	return compiler.complierChunk.AddConstant(NewObjVal(NewObjString(token.value)))
+	return compiler.currentChunk().AddConstant(NewObjVal(compiler.vm.copyString(token.value)))
+}
+
+func identifiersEqual(a *Token, b *Token) bool {
+	return a.value == b.value
+}
+
+func (compiler *Compiler) resolveLocal(functionCompiler *FunctionCompiler, name *Token) int {
+	for i := functionCompiler.localCount - 1; i >= 0; i-- {
+		local := &functionCompiler.locals[i]
+		if identifiersEqual(name, &local.name) {
+			if local.depth == -1 {
+				compiler.error("Can't read local variable in its own initializer.")
+			}
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (compiler *Compiler) addUpvalue(functionCompiler *FunctionCompiler, index byte, isLocal bool) int {
+	upvalueCount := functionCompiler.function.UpvalueCount
+
+	for i := 0; i < upvalueCount; i++ {
+		upvalue := &functionCompiler.upvalues[i]
+		if upvalue.index == index && upvalue.isLocal == isLocal {
+			return i
+		}
+	}
+
+	if upvalueCount == UINT8_COUNT {
+		compiler.error("Too many closure variables in function.")
+		return 0
+	}
+
+	functionCompiler.upvalues[upvalueCount].isLocal = isLocal
+	functionCompiler.upvalues[upvalueCount].index = index
+	functionCompiler.function.UpvalueCount += 1
+	return upvalueCount
+}
+
+func (compiler *Compiler) resolveUpvalue(functionCompiler *FunctionCompiler, name *Token) int {
+	if functionCompiler.enclosing == nil {
+		return -1
+	}
+
+	local := compiler.resolveLocal(functionCompiler.enclosing, name)
+	if local != -1 {
+		functionCompiler.enclosing.locals[local].isCaptured = true
+		return compiler.addUpvalue(functionCompiler, byte(local), true)
+	}
+
+	upvalue := compiler.resolveUpvalue(functionCompiler.enclosing, name)
+	if upvalue != -1 {
+		return compiler.addUpvalue(functionCompiler, byte(upvalue), false)
+	}
+
+	return -1
+}
+
+func (compiler *Compiler) addLocal(name Token) {
+	if compiler.functionCompiler.localCount == UINT8_COUNT {
+		compiler.error("Too many local variables in function.")
+		return
+	}
+
+	local := &compiler.functionCompiler.locals[compiler.functionCompiler.localCount]
+	compiler.functionCompiler.localCount += 1
+	local.name = name
+	local.depth = -1
+	local.isCaptured = false
+}
+
+func (compiler *Compiler) declareVariable() {
+	if compiler.functionCompiler.scopeDepth == 0 {
+		return
+	}
+
+	name := &compiler.previous
+	for i := compiler.functionCompiler.localCount - 1; i >= 0; i-- {
+		local := &compiler.functionCompiler.locals[i]
+		if local.depth != -1 && local.depth < compiler.functionCompiler.scopeDepth {
+			break
+		}
+
+		if identifiersEqual(name, &local.name) {
+			compiler.error("Already a variable with this name in this scope.")
+		}
+	}
+
+	compiler.addLocal(*name)
+}
+
+func (compiler *Compiler) markInitialized() {
+	if compiler.functionCompiler.scopeDepth == 0 {
+		return
+	}
+	compiler.functionCompiler.locals[compiler.functionCompiler.localCount-1].depth = compiler.functionCompiler.scopeDepth
 }
 
 func (compiler *Compiler) defineVariable(global int) {
-	constant0, constant1, constant2 := SplitConstant(global)
-	compiler.emitBytes(OP_DEFINE_GLOBAL, constant0, constant1, constant2)
+	if compiler.functionCompiler.scopeDepth > 0 {
+		compiler.markInitialized()
+		return
+	}
+
+	compiler.emitOperand(OP_DEFINE_GLOBAL, global)
 }
 
 func (compiler *Compiler) parseVariable(errorMessage string) int {
 	compiler.consume(TOKEN_IDENTIFIER, errorMessage)
+
+	compiler.declareVariable()
+	if compiler.functionCompiler.scopeDepth > 0 {
+		return 0
+	}
+
 	return compiler.identifierConstant(&compiler.previous)
 }
 
+func (compiler *Compiler) function(functionType FunctionType) {
+	compiler.beginFunction(functionType)
+	compiler.beginScope()
+
+	compiler.consume(TOKEN_LEFT_PAREN, "Expect '(' after function name.")
+	if !compiler.check(TOKEN_RIGHT_PAREN) {
+		for {
+			compiler.functionCompiler.function.Arity += 1
+			if compiler.functionCompiler.function.Arity > 255 {
+				compiler.errorAtCurrent("Can't have more than 255 parameters.")
+			}
+
+			constant := compiler.parseVariable("Expect parameter name.")
+			compiler.defineVariable(constant)
+
+			if !compiler.match(TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+	compiler.consume(TOKEN_RIGHT_PAREN, "Expect ')' after parameters.")
+	compiler.consume(TOKEN_LEFT_BRACE, "Expect '{' before function body.")
+	returns := compiler.block()
+
+	functionCompiler := compiler.functionCompiler
+	function := compiler.endCompiler(returns)
+
+	constant := compiler.currentChunk().AddConstant(NewObjVal(function))
+	compiler.emitOperand(OP_CLOSURE, constant)
+
+	for i := 0; i < function.UpvalueCount; i++ {
+		if functionCompiler.upvalues[i].isLocal {
+			compiler.emitByte(1)
+		} else {
+			compiler.emitByte(0)
+		}
+		compiler.emitByte(functionCompiler.upvalues[i].index)
+	}
+}
+
+func (compiler *Compiler) method() {
+	compiler.consume(TOKEN_IDENTIFIER, "Expect method name.")
+	constant := compiler.identifierConstant(&compiler.previous)
+
+	functionType := TYPE_METHOD
+	if compiler.previous.value == "init" {
+		functionType = TYPE_INITIALIZER
+	}
+	compiler.function(functionType)
+
+	compiler.emitOperand(OP_METHOD, constant)
+}
+
+func (compiler *Compiler) classDeclaration() {
+	compiler.consume(TOKEN_IDENTIFIER, "Expect class name.")
+	className := compiler.previous
+	nameConstant := compiler.identifierConstant(&compiler.previous)
+	compiler.declareVariable()
+
+	compiler.emitOperand(OP_CLASS, nameConstant)
+	compiler.defineVariable(nameConstant)
+
+	classCompiler := &ClassCompiler{enclosing: compiler.classCompiler}
+	compiler.classCompiler = classCompiler
+
+	if compiler.match(TOKEN_LESS) {
+		compiler.consume(TOKEN_IDENTIFIER, "Expect superclass name.")
+		compiler.variable(false)
+
+		if identifiersEqual(&className, &compiler.previous) {
+			compiler.error("A class can't inherit from itself.")
+		}
+
+		compiler.beginScope()
+		compiler.addLocal(syntheticToken("super"))
+		compiler.defineVariable(0)
+
+		compiler.namedVariable(className, false)
+		compiler.emitByte(OP_INHERIT)
+		classCompiler.hasSuperclass = true
+	}
+
+	compiler.namedVariable(className, false)
+	compiler.consume(TOKEN_LEFT_BRACE, "Expect '{' before class body.")
+	for !compiler.check(TOKEN_RIGHT_BRACE) && !compiler.check(TOKEN_EOF) {
+		compiler.method()
+	}
+	compiler.consume(TOKEN_RIGHT_BRACE, "Expect '}' after class body.")
+	compiler.emitByte(OP_POP)
+
+	if classCompiler.hasSuperclass {
+		compiler.endScope()
+	}
+
+	compiler.classCompiler = compiler.classCompiler.enclosing
+}
+
+func (compiler *Compiler) funDeclaration() {
+	global := compiler.parseVariable("Expect function name.")
+	compiler.markInitialized()
+	compiler.function(TYPE_FUNCTION)
+	compiler.defineVariable(global)
+}
+
 func (compiler *Compiler) varDeclaration() {
 	global := compiler.parseVariable("Expect variable name.")
 
@@ -226,7 +768,11 @@ func (compiler *Compiler) varDeclaration() {
 }
 
 func (compiler *Compiler) declaration() {
-	if compiler.match(TOKEN_VAR) {
+	if compiler.match(TOKEN_CLASS) {
+		compiler.classDeclaration()
+	} else if compiler.match(TOKEN_FUN) {
+		compiler.funDeclaration()
+	} else if compiler.match(TOKEN_VAR) {
 		compiler.varDeclaration()
 	} else {
 		compiler.statement()
@@ -242,6 +788,104 @@ func (compiler *Compiler) printStatement() {
 	compiler.emitByte(OP_PRINT)
 }
 
+func (compiler *Compiler) returnStatement() {
+	if compiler.functionCompiler.functionType == TYPE_SCRIPT {
+		compiler.error("Can't return from top-level code.")
+	}
+
+	if compiler.match(TOKEN_SEMICOLON) {
+		compiler.emitReturn()
+	} else {
+		if compiler.functionCompiler.functionType == TYPE_INITIALIZER {
+			compiler.error("Can't return a value from an initializer.")
+		}
+
+		compiler.expression()
+		compiler.consume(TOKEN_SEMICOLON, "Expect ';' after return value.")
+		compiler.emitByte(OP_RETURN)
+	}
+}
+
+func (compiler *Compiler) ifStatement() {
+	compiler.consume(TOKEN_LEFT_PAREN, "Expect '(' after 'if'.")
+	compiler.expression()
+	compiler.consume(TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
+
+	thenJump := compiler.emitJump(OP_JUMP_IF_FALSE)
+	compiler.emitByte(OP_POP)
+	compiler.statement()
+
+	elseJump := compiler.emitJump(OP_JUMP)
+
+	compiler.patchJump(thenJump)
+	compiler.emitByte(OP_POP)
+
+	if compiler.match(TOKEN_ELSE) {
+		compiler.statement()
+	}
+	compiler.patchJump(elseJump)
+}
+
+func (compiler *Compiler) whileStatement() {
+	loopStart := compiler.markJumpTarget()
+	compiler.consume(TOKEN_LEFT_PAREN, "Expect '(' after 'while'.")
+	compiler.expression()
+	compiler.consume(TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
+
+	exitJump := compiler.emitJump(OP_JUMP_IF_FALSE)
+	compiler.emitByte(OP_POP)
+	compiler.statement()
+	compiler.emitLoop(loopStart)
+
+	compiler.patchJump(exitJump)
+	compiler.emitByte(OP_POP)
+}
+
+func (compiler *Compiler) forStatement() {
+	compiler.beginScope()
+	compiler.consume(TOKEN_LEFT_PAREN, "Expect '(' after 'for'.")
+	if compiler.match(TOKEN_SEMICOLON) {
+		// No initializer.
+	} else if compiler.match(TOKEN_VAR) {
+		compiler.varDeclaration()
+	} else {
+		compiler.expressionStatement()
+	}
+
+	loopStart := compiler.markJumpTarget()
+	exitJump := -1
+	if !compiler.match(TOKEN_SEMICOLON) {
+		compiler.expression()
+		compiler.consume(TOKEN_SEMICOLON, "Expect ';' after loop condition.")
+
+		// Jump out of the loop if the condition is false.
+		exitJump = compiler.emitJump(OP_JUMP_IF_FALSE)
+		compiler.emitByte(OP_POP) // Condition.
+	}
+
+	if !compiler.match(TOKEN_RIGHT_PAREN) {
+		bodyJump := compiler.emitJump(OP_JUMP)
+		incrementStart := compiler.markJumpTarget()
+		compiler.expression()
+		compiler.emitByte(OP_POP)
+		compiler.consume(TOKEN_RIGHT_PAREN, "Expect ')' after for clauses.")
+
+		compiler.emitLoop(loopStart)
+		loopStart = incrementStart
+		compiler.patchJump(bodyJump)
+	}
+
+	compiler.statement()
+	compiler.emitLoop(loopStart)
+
+	if exitJump != -1 {
+		compiler.patchJump(exitJump)
+		compiler.emitByte(OP_POP) // Condition.
+	}
+
+	compiler.endScope()
+}
+
 func (compiler *Compiler) synchronize() {
 	compiler.panicMode = false
 	for compiler.current.tokenType != TOKEN_EOF {
@@ -267,26 +911,80 @@ func (compiler *Compiler) expression() {
 	compiler.parsePrecedence(PREC_ASSIGNMENT)
 }
 
+func (compiler *Compiler) beginScope() {
+	compiler.functionCompiler.scopeDepth += 1
+}
+
+func (compiler *Compiler) endScope() {
+	compiler.functionCompiler.scopeDepth -= 1
+
+	for compiler.functionCompiler.localCount > 0 &&
+		compiler.functionCompiler.locals[compiler.functionCompiler.localCount-1].depth > compiler.functionCompiler.scopeDepth {
+		if compiler.functionCompiler.locals[compiler.functionCompiler.localCount-1].isCaptured {
+			compiler.emitByte(OP_CLOSE_UPVALUE)
+		} else {
+			compiler.emitByte(OP_POP)
+		}
+		compiler.functionCompiler.localCount -= 1
+	}
+}
+
+// block compiles declarations up to the closing brace and reports whether
+// the block ends in a return statement.
+func (compiler *Compiler) block() bool {
+	deadFrom := -1
+	for !compiler.check(TOKEN_RIGHT_BRACE) && !compiler.check(TOKEN_EOF) {
+		returns := compiler.check(TOKEN_RETURN)
+		compiler.declaration()
+
+		// Anything after a return is still compiled, for its errors, but
+		// never run, so it is dropped.
+		if returns && deadFrom == -1 {
+			deadFrom = compiler.currentChunk().Count
+		}
+	}
+
+	if deadFrom != -1 {
+		compiler.truncate(deadFrom)
+	}
+
+	compiler.consume(TOKEN_RIGHT_BRACE, "Expect '}' after block.")
+	return deadFrom != -1
+}
+
 func (compiler *Compiler) statement() {
 	if compiler.match(TOKEN_PRINT) {
 		compiler.printStatement()
+	} else if compiler.match(TOKEN_FOR) {
+		compiler.forStatement()
+	} else if compiler.match(TOKEN_IF) {
+		compiler.ifStatement()
+	} else if compiler.match(TOKEN_RETURN) {
+		compiler.returnStatement()
+	} else if compiler.match(TOKEN_WHILE) {
+		compiler.whileStatement()
+	} else if compiler.match(TOKEN_LEFT_BRACE) {
+		compiler.beginScope()
+		compiler.block()
+		compiler.endScope()
 	} else {
 		compiler.expressionStatement()
 	}
 }
 
-func (compiler *Compiler) number() {
+func (compiler *Compiler) number(canAssign bool) {
 	value, _ := strconv.ParseFloat(compiler.previous.value, 64)
-	compiler.emitConstant(NewNumberVal(value))
+	compiler.emitLiteral(&compiler.previous, NewNumberVal(value))
 }
 
-func (compiler *Compiler) grouping() {
+func (compiler *Compiler) grouping(canAssign bool) {
 	compiler.expression()
 	compiler.consume(TOKEN_RIGHT_PAREN, "Expect ')' after expression.")
 }
 
-func (compiler *Compiler) unary() {
-	operationType := compiler.previous.tokenType
+func (compiler *Compiler) unary(canAssign bool) {
+	operator := compiler.previous
+	operationType := operator.tokenType
 
 	// Compile the operand.
 	compiler.parsePrecedence(PREC_UNARY)
@@ -294,46 +992,92 @@ func (compiler *Compiler) unary() {
 	// Emit the operator instruction.
 	switch operationType {
 	case TOKEN_BANG:
-		compiler.emitByte(OP_NOT)
+		compiler.emitOperation(&operator, OP_NOT)
 	case TOKEN_MINUS:
-		compiler.emitByte(OP_NEGATE)
+		compiler.emitOperation(&operator, OP_NEGATE)
 	default:
 		return // Unreachable.
 	}
 }
 
-func (compiler *Compiler) binary() {
-	operatorType := compiler.previous.tokenType
+func (compiler *Compiler) binary(canAssign bool) {
+	operator := compiler.previous
+	operatorType := operator.tokenType
 
 	rule := getRule(operatorType)
 	compiler.parsePrecedence(Precedence(rule.precedence + 1))
 
 	switch operatorType {
 	case TOKEN_PLUS:
-		compiler.emitByte(OP_ADD)
+		compiler.emitOperation(&operator, OP_ADD)
 	case TOKEN_MINUS:
-		compiler.emitByte(OP_SUBTRACT)
+		compiler.emitOperation(&operator, OP_SUBTRACT)
 	case TOKEN_STAR:
-		compiler.emitByte(OP_MULTIPLY)
+		compiler.emitOperation(&operator, OP_MULTIPLY)
 	case TOKEN_SLASH:
-		compiler.emitByte(OP_DIVIDE)
+		compiler.emitOperation(&operator, OP_DIVIDE)
 	case TOKEN_EQUAL_EQUAL:
-		compiler.emitByte(OP_EQUAL)
+		compiler.emitOperation(&operator, OP_EQUAL)
 	case TOKEN_BANG_EQUAL:
-		compiler.emitBytes(OP_EQUAL, OP_NOT)
+		compiler.emitOperation(&operator, OP_EQUAL)
+		compiler.emitOperation(&operator, OP_NOT)
 	case TOKEN_GREATER:
-		compiler.emitByte(OP_GREATER)
+		compiler.emitOperation(&operator, OP_GREATER)
 	case TOKEN_GREATER_EQUAL:
-		compiler.emitBytes(OP_LESS, OP_NOT)
+		compiler.emitOperation(&operator, OP_LESS)
+		compiler.emitOperation(&operator, OP_NOT)
 	case TOKEN_LESS:
-		compiler.emitByte(OP_LESS)
+		compiler.emitOperation(&operator, OP_LESS)
 	case TOKEN_LESS_EQUAL:
-		compiler.emitBytes(OP_GREATER, OP_NOT)
+		compiler.emitOperation(&operator, OP_GREATER)
+		compiler.emitOperation(&operator, OP_NOT)
 	default:
 		return // Unreachable.
 	}
 }
 
+func (compiler *Compiler) argumentList() byte {
+	argCount := 0
+	if !compiler.check(TOKEN_RIGHT_PAREN) {
+		for {
+			compiler.expression()
+			if argCount == 255 {
+				compiler.error("Can't have more than 255 arguments.")
+			}
+			argCount += 1
+
+			if !compiler.match(TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+
+	compiler.consume(TOKEN_RIGHT_PAREN, "Expect ')' after arguments.")
+	return byte(argCount)
+}
+
+func (compiler *Compiler) call(canAssign bool) {
+	argCount := compiler.argumentList()
+	compiler.emitBytes(OP_CALL, argCount)
+}
+
+func (compiler *Compiler) dot(canAssign bool) {
+	compiler.consume(TOKEN_IDENTIFIER, "Expect property name after '.'.")
+	property := compiler.previous
+	name := compiler.identifierConstant(&property)
+
+	if canAssign && compiler.match(TOKEN_EQUAL) {
+		compiler.expression()
+		compiler.emitOperandAt(&property, OP_SET_PROPERTY, name)
+	} else if compiler.match(TOKEN_LEFT_PAREN) {
+		argCount := compiler.argumentList()
+		compiler.emitOperand(OP_INVOKE, name)
+		compiler.emitByte(argCount)
+	} else {
+		compiler.emitOperand(OP_GET_PROPERTY, name)
+	}
+}
+
 func (compiler *Compiler) parsePrecedence(precedence Precedence) {
 	compiler.advance()
 	prefix := getRule(compiler.previous.tokenType).prefix
@@ -341,37 +1085,124 @@ func (compiler *Compiler) parsePrecedence(precedence Precedence) {
 		compiler.error("Expect expression.")
 		return
 	}
-	prefix()
+
+	canAssign := precedence <= PREC_ASSIGNMENT
+	prefix(compiler, canAssign)
 
 	for precedence <= getRule(compiler.current.tokenType).precedence {
 		compiler.advance()
 		infix := getRule(compiler.previous.tokenType).infix
-		infix()
+		infix(compiler, canAssign)
 	}
+
+	if canAssign && compiler.match(TOKEN_EQUAL) {
+		compiler.error("Invalid assignment target.")
+	}
+}
+
+func (compiler *Compiler) and(canAssign bool) {
+	endJump := compiler.emitJump(OP_JUMP_IF_FALSE)
+
+	compiler.emitByte(OP_POP)
+	compiler.parsePrecedence(PREC_AND)
+
+	compiler.patchJump(endJump)
 }
 
-func (compiler *Compiler) literal() {
+func (compiler *Compiler) or(canAssign bool) {
+	elseJump := compiler.emitJump(OP_JUMP_IF_FALSE)
+	endJump := compiler.emitJump(OP_JUMP)
+
+	compiler.patchJump(elseJump)
+	compiler.emitByte(OP_POP)
+
+	compiler.parsePrecedence(PREC_OR)
+	compiler.patchJump(endJump)
+}
+
+func (compiler *Compiler) literal(canAssign bool) {
 	switch compiler.previous.tokenType {
 	case TOKEN_NIL:
-		compiler.emitByte(OP_NIL)
+		compiler.emitLiteral(&compiler.previous, NewNilVal())
 	case TOKEN_FALSE:
-		compiler.emitByte(OP_FALSE)
+		compiler.emitLiteral(&compiler.previous, NewBoolVal(false))
 	case TOKEN_TRUE:
-		compiler.emitByte(OP_TRUE)
+		compiler.emitLiteral(&compiler.previous, NewBoolVal(true))
 	}
 }
 
-func (compiler *Compiler) string() {
+func (compiler *Compiler) string(canAssign bool) {
 	str := compiler.previous.value[1 : len(compiler.previous.value)-1]
-	compiler.emitConstant(NewObjVal(NewObjString(str)))
+	compiler.emitLiteral(&compiler.previous, NewObjVal(compiler.vm.copyString(str)))
 }
 
-func (compiler *Compiler) variable() {
-	compiler.namedVariable(compiler.previous)
+func (compiler *Compiler) variable(canAssign bool) {
+	compiler.namedVariable(compiler.previous, canAssign)
 }
 
-func (compiler *Compiler) namedVariable(name Token) {
-	nameConstant := compiler.identifierConstant(&name)
-	constant0, constant1, constant2 := SplitConstant(nameConstant)
-	compiler.emitBytes(OP_GET_GLOBAL, constant0, constant1, constant2)
+func syntheticToken(text string) Token {
+	return Token{
+		tokenType: TOKEN_IDENTIFIER,
+		value:     text,
+		length:    len(text),
+	}
+}
+
+func (compiler *Compiler) super(canAssign bool) {
+	if compiler.classCompiler == nil {
+		compiler.error("Can't use 'super' outside of a class.")
+	} else if !compiler.classCompiler.hasSuperclass {
+		compiler.error("Can't use 'super' in a class with no superclass.")
+	}
+
+	compiler.consume(TOKEN_DOT, "Expect '.' after 'super'.")
+	compiler.consume(TOKEN_IDENTIFIER, "Expect superclass method name.")
+	name := compiler.identifierConstant(&compiler.previous)
+
+	compiler.namedVariable(syntheticToken("this"), false)
+	if compiler.match(TOKEN_LEFT_PAREN) {
+		argCount := compiler.argumentList()
+		compiler.namedVariable(syntheticToken("super"), false)
+		compiler.emitOperand(OP_SUPER_INVOKE, name)
+		compiler.emitByte(argCount)
+	} else {
+		compiler.namedVariable(syntheticToken("super"), false)
+		compiler.emitOperand(OP_GET_SUPER, name)
+	}
+}
+
+func (compiler *Compiler) this(canAssign bool) {
+	if compiler.classCompiler == nil {
+		compiler.error("Can't use 'this' outside of a class.")
+		return
+	}
+
+	compiler.variable(false)
+}
+
+func (compiler *Compiler) namedVariable(name Token, canAssign bool) {
+	var getOp, setOp byte
+	var operand int
+
+	if arg := compiler.resolveLocal(compiler.functionCompiler, &name); arg != -1 {
+		getOp = OP_GET_LOCAL
+		setOp = OP_SET_LOCAL
+		operand = arg
+	} else if arg := compiler.resolveUpvalue(compiler.functionCompiler, &name); arg != -1 {
+		getOp = OP_GET_UPVALUE
+		setOp = OP_SET_UPVALUE
+		operand = arg
+	} else {
+		getOp = OP_GET_GLOBAL
+		setOp = OP_SET_GLOBAL
+		operand = compiler.identifierConstant(&name)
+	}
+
+	if canAssign && compiler.match(TOKEN_EQUAL) {
+		compiler.expression()
+		// Point errors from the store at the variable, not the value.
+		compiler.emitOperandAt(&name, setOp, operand)
+	} else {
+		compiler.emitOperand(getOp, operand)
+	}
 }
@@ -0,0 +1,285 @@
+package glox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// disassemble compiles source and disassembles the script followed by the
+// functions in its constant pool.
+func disassemble(t *testing.T, source string) string {
+	t.Helper()
+
+	vm := NewVM()
+	vm.Init()
+	defer vm.Free()
+
+	function, errs := vm.Compile(source)
+	if errs != nil {
+		t.Fatalf("Compile(%q) failed: %v", source, CompileErrors(errs))
+	}
+	return disassembleFunction(function)
+}
+
+// disassembleFunction disassembles function followed by the functions in
+// its constant pool.
+func disassembleFunction(function *ObjFunction) string {
+	var out bytes.Buffer
+	var walk func(function *ObjFunction)
+	walk = func(function *ObjFunction) {
+		function.Chunk.DisassembleChunk(&out, functionName(function))
+		for i := 0; i < function.Chunk.Constants.Count; i++ {
+			if nested := (*function.Chunk.Constants.Values)[i].AsFunction(); nested != nil {
+				walk(nested)
+			}
+		}
+	}
+	walk(function)
+	return out.String()
+}
+
+func TestCompileDisassembly(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []string
+	}{
+		{
+			"folds arithmetic",
+			"print 1 + 2 * 3;",
+			[]string{
+				"== script ==",
+				"0000    1 OP_CONSTANT         0 '7'",
+				"0002    | OP_PRINT",
+				"0003    | OP_NIL",
+				"0004    | OP_RETURN",
+				"   5    | OP_DONE",
+			},
+		},
+		{
+			"folds left to right",
+			"print 1 + 2 + 3;",
+			[]string{
+				"== script ==",
+				"0000    1 OP_CONSTANT         0 '6'",
+				"0002    | OP_PRINT",
+				"0003    | OP_NIL",
+				"0004    | OP_RETURN",
+				"   5    | OP_DONE",
+			},
+		},
+		{
+			"folds string concatenation",
+			"print \"a\" + \"b\";",
+			[]string{
+				"== script ==",
+				"0000    1 OP_CONSTANT         0 'ab'",
+				"0002    | OP_PRINT",
+				"0003    | OP_NIL",
+				"0004    | OP_RETURN",
+				"   5    | OP_DONE",
+			},
+		},
+		{
+			"folds unary operators and comparisons",
+			"print !(1 < 2); print -(-4);",
+			[]string{
+				"== script ==",
+				"0000    1 OP_FALSE",
+				"0001    | OP_PRINT",
+				"0002    | OP_CONSTANT         0 '4'",
+				"0004    | OP_PRINT",
+				"0005    | OP_NIL",
+				"0006    | OP_RETURN",
+				"   7    | OP_DONE",
+			},
+		},
+		{
+			"keeps operations that fail at runtime",
+			"print -\"s\";",
+			[]string{
+				"== script ==",
+				"0000    1 OP_CONSTANT         0 's'",
+				"0002    | OP_NEGATE",
+				"0003    | OP_PRINT",
+				"0004    | OP_NIL",
+				"0005    | OP_RETURN",
+				"   6    | OP_DONE",
+			},
+		},
+		{
+			"keeps operations on variables",
+			"var a = 1; print a + 2;",
+			[]string{
+				"== script ==",
+				"0000    1 OP_CONSTANT         1 '1'",
+				"0002    | OP_DEFINE_GLOBAL    0 'a'",
+				"0004    | OP_GET_GLOBAL       0 'a'",
+				"0006    | OP_CONSTANT         2 '2'",
+				"0008    | OP_ADD",
+				"0009    | OP_PRINT",
+				"0010    | OP_NIL",
+				"0011    | OP_RETURN",
+				"  12    | OP_DONE",
+			},
+		},
+		{
+			"doesn't fold across a jump target",
+			"print (nil or 1) + 2;",
+			[]string{
+				"== script ==",
+				"0000    1 OP_NIL",
+				"0001    | OP_JUMP_IF_FALSE    1 -> 7",
+				"0004    | OP_JUMP             4 -> 10",
+				"0007    | OP_POP",
+				"0008    | OP_CONSTANT         0 '1'",
+				"0010    | OP_CONSTANT         1 '2'",
+				"0012    | OP_ADD",
+				"0013    | OP_PRINT",
+				"0014    | OP_NIL",
+				"0015    | OP_RETURN",
+				"  16    | OP_DONE",
+			},
+		},
+		{
+			"dedupes constants",
+			"print 1; print \"x\"; print 1; print \"x\";",
+			[]string{
+				"== script ==",
+				"0000    1 OP_CONSTANT         0 '1'",
+				"0002    | OP_PRINT",
+				"0003    | OP_CONSTANT         1 'x'",
+				"0005    | OP_PRINT",
+				"0006    | OP_CONSTANT         0 '1'",
+				"0008    | OP_PRINT",
+				"0009    | OP_CONSTANT         1 'x'",
+				"0011    | OP_PRINT",
+				"0012    | OP_NIL",
+				"0013    | OP_RETURN",
+				"  14    | OP_DONE",
+			},
+		},
+		{
+			"drops code after return",
+			"fun f() {\n  return 1;\n  print 2;\n}",
+			[]string{
+				"== script ==",
+				"0000    4 OP_CLOSURE          1 <fn f>",
+				"0002    | OP_DEFINE_GLOBAL    0 'f'",
+				"0004    | OP_NIL",
+				"0005    | OP_RETURN",
+				"   6    | OP_DONE",
+				"== f ==",
+				"0000    2 OP_CONSTANT         0 '1'",
+				"0002    | OP_RETURN",
+				"   3    | OP_DONE",
+			},
+		},
+		{
+			"drops the implicit return after an initializer's return",
+			"class A {\n  init() { return; }\n}",
+			[]string{
+				"== script ==",
+				"0000    1 OP_CLASS            0 'A'",
+				"0002    | OP_DEFINE_GLOBAL    0 'A'",
+				"0004    | OP_GET_GLOBAL       0 'A'",
+				"0006    2 OP_CLOSURE          2 <fn init>",
+				"0008    | OP_METHOD           1 'init'",
+				"0010    3 OP_POP",
+				"0011    | OP_NIL",
+				"0012    | OP_RETURN",
+				"  13    | OP_DONE",
+				"== init ==",
+				"0000    2 OP_GET_LOCAL        0",
+				"0002    | OP_RETURN",
+				"   3    | OP_DONE",
+			},
+		},
+		{
+			"keeps the implicit return when the body can fall through",
+			"fun g(x) {\n  if (x) return 1;\n}",
+			[]string{
+				"== script ==",
+				"0000    3 OP_CLOSURE          1 <fn g>",
+				"0002    | OP_DEFINE_GLOBAL    0 'g'",
+				"0004    | OP_NIL",
+				"0005    | OP_RETURN",
+				"   6    | OP_DONE",
+				"== g ==",
+				"0000    2 OP_GET_LOCAL        1",
+				"0002    | OP_JUMP_IF_FALSE    2 -> 12",
+				"0005    | OP_POP",
+				"0006    | OP_CONSTANT         0 '1'",
+				"0008    | OP_RETURN",
+				"0009    | OP_JUMP             9 -> 13",
+				"0012    | OP_POP",
+				"0013    3 OP_NIL",
+				"0014    | OP_RETURN",
+				"  15    | OP_DONE",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := strings.Join(test.want, "\n") + "\n"
+			if got := disassemble(t, test.source); got != want {
+				t.Errorf("disassembly of %q =\n%s\nwant\n%s", test.source, got, want)
+			}
+		})
+	}
+}
+
+// TestCompileInParallel runs a different script on each goroutine. Any
+// compiler or scanner state shared between them would mix their tokens,
+// errors or output; run it with -race to also catch unsynchronized access.
+func TestCompileInParallel(t *testing.T) {
+	const goroutines = 16
+
+	var wait sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+
+			for round := 0; round < 20; round++ {
+				source := fmt.Sprintf(`
+fun count(n) {
+  var total = 0;
+  for (var i = 0; i < n; i = i + 1) total = total + i;
+  return total;
+}
+class Named { init(name) { this.name = name; } }
+print Named("g%d").name;
+print count(%d);
+`, i, i)
+				want := fmt.Sprintf("g%d\n%d\n", i, i*(i-1)/2)
+
+				var out bytes.Buffer
+				if _, err := Interpret(source, WithStdout(&out)); err != nil {
+					t.Errorf("goroutine %d: %v", i, err)
+					return
+				}
+				if out.String() != want {
+					t.Errorf("goroutine %d printed %q, want %q", i, out.String(), want)
+					return
+				}
+
+				// Every goroutine gets exactly its own compile error back.
+				broken := fmt.Sprintf("var v%d = ;", i)
+				_, err := Interpret(broken, WithStdout(&out))
+				var compileErrors CompileErrors
+				if !errors.As(err, &compileErrors) || len(compileErrors) != 1 ||
+					compileErrors[0].Message != "Expect expression." || compileErrors[0].Column != 9+len(fmt.Sprint(i)) {
+					t.Errorf("goroutine %d: Interpret(%q) = %v", i, broken, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wait.Wait()
+}
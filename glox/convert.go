@@ -0,0 +1,538 @@
+package glox
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+type fromGoConfig struct {
+	hostObjects bool
+	// seen maps the structs and maps converted so far to their instances,
+	// so values that refer back to themselves convert to cyclic instances.
+	seen map[visit]Value
+}
+
+type visit struct {
+	pointer uintptr
+	typ     reflect.Type
+}
+
+type FromGoOption func(config *fromGoConfig)
+
+// AsHostObject makes FromGo wrap struct pointers in an ObjHost instead of
+// copying them, so Lox reads and writes the Go struct's exported fields and
+// calls its exported methods directly.
+func AsHostObject() FromGoOption {
+	return func(config *fromGoConfig) {
+		config.hostObjects = true
+	}
+}
+
+// FromGo converts a Go value into a Lox value. Numbers of every kind become
+// Lox numbers, string-keyed maps and structs become instances, and slices,
+// arrays and other maps become host objects with a length property and a
+// get(index) method. Values and objects already belonging to Lox pass
+// through unchanged.
+func FromGo(value any, options ...FromGoOption) (Value, error) {
+	config := fromGoConfig{seen: map[visit]Value{}}
+	for _, option := range options {
+		option(&config)
+	}
+
+	return config.fromGo(reflect.ValueOf(value))
+}
+
+func (config *fromGoConfig) fromGo(value reflect.Value) (Value, error) {
+	if !value.IsValid() {
+		return NewNilVal(), nil
+	}
+
+	if value.CanInterface() {
+		switch v := value.Interface().(type) {
+		case Value:
+			return v, nil
+		case Obj:
+			if value.Kind() == reflect.Pointer && value.IsNil() {
+				return NewNilVal(), nil
+			}
+			return NewObjVal(v), nil
+		}
+	}
+
+	switch value.Kind() {
+	case reflect.Bool:
+		return NewBoolVal(value.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NewNumberVal(float64(value.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return NewNumberVal(float64(value.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		return NewNumberVal(value.Float()), nil
+	case reflect.String:
+		return String(value.String()), nil
+	case reflect.Interface:
+		return config.fromGo(value.Elem())
+	case reflect.Pointer:
+		if value.IsNil() {
+			return NewNilVal(), nil
+		}
+		if value.Elem().Kind() != reflect.Struct {
+			return config.fromGo(value.Elem())
+		}
+		if config.hostObjects {
+			return NewObjVal(NewObjHost(value)), nil
+		}
+		return config.structToInstance(value.Elem(), visit{value.Pointer(), value.Type()})
+	case reflect.Slice, reflect.Array:
+		if value.Kind() == reflect.Slice && value.IsNil() {
+			return NewNilVal(), nil
+		}
+		return NewObjVal(NewObjHost(value)), nil
+	case reflect.Map:
+		if value.IsNil() {
+			return NewNilVal(), nil
+		}
+		if value.Type().Key().Kind() != reflect.String {
+			return NewObjVal(NewObjHost(value)), nil
+		}
+		return config.mapToInstance(value)
+	case reflect.Struct:
+		return config.structToInstance(value, visit{})
+	}
+
+	return NewNilVal(), fmt.Errorf("cannot convert %s to a Lox value", value.Type())
+}
+
+func (config *fromGoConfig) mapToInstance(value reflect.Value) (Value, error) {
+	visited := visit{value.Pointer(), value.Type()}
+	if instance, ok := config.seen[visited]; ok {
+		return instance, nil
+	}
+
+	instance := NewObjInstance(NewObjClass(NewObjString("Map")))
+	config.seen[visited] = NewObjVal(instance)
+
+	keys := value.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+	for _, key := range keys {
+		field, err := config.fromGo(value.MapIndex(key))
+		if err != nil {
+			return NewNilVal(), err
+		}
+		instance.Fields.Set(NewObjString(key.String()), field)
+	}
+
+	return NewObjVal(instance), nil
+}
+
+// structToInstance converts a struct. A struct reached through a pointer is
+// visited under that pointer, so reaching it again reuses the instance.
+func (config *fromGoConfig) structToInstance(value reflect.Value, visited visit) (Value, error) {
+	if instance, ok := config.seen[visited]; ok {
+		return instance, nil
+	}
+
+	name := value.Type().Name()
+	if name == "" {
+		name = "Struct"
+	}
+	instance := NewObjInstance(NewObjClass(NewObjString(name)))
+	if visited.pointer != 0 {
+		config.seen[visited] = NewObjVal(instance)
+	}
+
+	for i := 0; i < value.NumField(); i++ {
+		if !value.Type().Field(i).IsExported() {
+			continue
+		}
+
+		field, err := config.fromGo(value.Field(i))
+		if err != nil {
+			return NewNilVal(), err
+		}
+		instance.Fields.Set(NewObjString(value.Type().Field(i).Name), field)
+	}
+
+	return NewObjVal(instance), nil
+}
+
+// ToGo converts a Lox value into a Go value: nil, bool, float64 or string
+// for primitives, map[string]any for instances, the wrapped Go value for
+// host objects, and the Obj itself for functions, classes and the like.
+func (val Value) ToGo() any {
+	return val.toGo(map[*ObjInstance]map[string]any{})
+}
+
+func (val Value) toGo(seen map[*ObjInstance]map[string]any) any {
+	switch val.Type {
+	case VAL_NIL:
+		return nil
+	case VAL_BOOL:
+		return val.AsBool()
+	case VAL_NUMBER:
+		return val.AsNumber()
+	}
+
+	switch object := val.AsObj().(type) {
+	case *ObjString:
+		return string(object.Chars)
+	case *ObjHost:
+		return object.Value.Interface()
+	case *ObjInstance:
+		if fields, ok := seen[object]; ok {
+			return fields
+		}
+
+		fields := map[string]any{}
+		seen[object] = fields
+		for i := 0; i < object.Fields.capacity; i++ {
+			entry := &object.Fields.Entries[i]
+			if entry.Key != nil {
+				fields[string(entry.Key.Chars)] = entry.Value.toGo(seen)
+			}
+		}
+		return fields
+	default:
+		return object
+	}
+}
+
+// toGoType converts a Lox value into a Go value assignable to typ.
+func toGoType(value Value, typ reflect.Type) (reflect.Value, error) {
+	if value.IsNil() {
+		switch typ.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Slice, reflect.Map, reflect.Func, reflect.Chan:
+			return reflect.Zero(typ), nil
+		}
+		return reflect.Value{}, fmt.Errorf("cannot use nil as %s", typ)
+	}
+
+	goValue := reflect.ValueOf(value.ToGo())
+	if goValue.Type().AssignableTo(typ) {
+		return goValue, nil
+	}
+
+	if isNumberKind(goValue.Kind()) && isNumberKind(typ.Kind()) {
+		return goValue.Convert(typ), nil
+	}
+	if goValue.Kind() == reflect.String && typ.Kind() == reflect.String {
+		return goValue.Convert(typ), nil
+	}
+
+	return reflect.Value{}, fmt.Errorf("cannot use %s as %s", goValue.Type(), typ)
+}
+
+func isNumberKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// adopt hands a value built outside the VM, e.g. with String or FromGo, over
+// to it: strings are swapped for their interned copy and objects are
+// registered with the collector, along with everything they reference.
+// Values the VM can't run safely, such as a closure missing upvalues, a
+// class whose methods aren't closures or an object owned by another VM, are
+// rejected before anything is registered. Strings from another VM are
+// simply interned again.
+func (vm *VM) adopt(value Value) (Value, error) {
+	if !value.IsObj() {
+		return value, nil
+	}
+	if err := vm.validate(value, map[Obj]bool{}); err != nil {
+		return value, err
+	}
+	return NewObjVal(vm.adoptObject(value.AsObj())), nil
+}
+
+// validate checks value and everything it reaches that the VM doesn't own
+// yet. Objects the VM owns were checked when they were adopted or created.
+func (vm *VM) validate(value Value, seen map[Obj]bool) error {
+	if !value.IsObj() {
+		return nil
+	}
+	object := value.AsObj()
+	if object.header().owner == vm || seen[object] {
+		return nil
+	}
+	seen[object] = true
+
+	// Another VM may still collect or mutate the object, and its strings
+	// are interned there, so only strings can be copied over.
+	if _, ok := object.(*ObjString); !ok && object.header().owner != nil {
+		var name strings.Builder
+		PrintValue(&name, value)
+		return fmt.Errorf("%s belongs to another VM", name.String())
+	}
+
+	switch object := object.(type) {
+	case *ObjClass:
+		for i := 0; i < object.Methods.capacity; i++ {
+			entry := &object.Methods.Entries[i]
+			if entry.Key == nil {
+				continue
+			}
+			if !entry.Value.IsClosure() {
+				return fmt.Errorf("method '%s' of class %s is not a closure", entry.Key.Chars, object.Name.Chars)
+			}
+			if err := vm.validate(entry.Value, seen); err != nil {
+				return err
+			}
+		}
+	case *ObjInstance:
+		if err := vm.validate(NewObjVal(object.Class), seen); err != nil {
+			return err
+		}
+		for i := 0; i < object.Fields.capacity; i++ {
+			if entry := &object.Fields.Entries[i]; entry.Key != nil {
+				if err := vm.validate(entry.Value, seen); err != nil {
+					return err
+				}
+			}
+		}
+	case *ObjClosure:
+		if object.Function == nil {
+			return errors.New("closure has no function")
+		}
+		name := functionName(object.Function)
+		if len(object.Upvalues) != object.Function.UpvalueCount {
+			return fmt.Errorf("closure of %s has %d upvalues but needs %d", name, len(object.Upvalues), object.Function.UpvalueCount)
+		}
+		for i, upvalue := range object.Upvalues {
+			if upvalue == nil {
+				return fmt.Errorf("upvalue %d of %s is missing", i, name)
+			}
+			if err := vm.validate(NewObjVal(upvalue), seen); err != nil {
+				return err
+			}
+		}
+		return vm.validate(NewObjVal(object.Function), seen)
+	case *ObjUpvalue:
+		if object.Location == nil {
+			return errors.New("upvalue has no location")
+		}
+		return vm.validate(*object.Location, seen)
+	case *ObjBoundMethod:
+		if object.Method == nil {
+			return errors.New("bound method has no method")
+		}
+		if err := vm.validate(object.Receiver, seen); err != nil {
+			return err
+		}
+		return vm.validate(NewObjVal(object.Method), seen)
+	case *ObjFunction:
+		for i := 0; i < object.Chunk.Constants.Count; i++ {
+			if err := vm.validate((*object.Chunk.Constants.Values)[i], seen); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// adoptObject registers an object that validate accepted.
+func (vm *VM) adoptObject(object Obj) Obj {
+	if object.header().owner == vm {
+		return object
+	}
+
+	if str, ok := object.(*ObjString); ok {
+		return vm.copyString(string(str.Chars))
+	}
+
+	ALLOCATE_OBJ(vm, object)
+	vm.Push(NewObjVal(object))
+
+	switch object := object.(type) {
+	case *ObjClass:
+		object.Name = vm.adoptObject(object.Name).(*ObjString)
+		vm.adoptTable(&object.Methods)
+	case *ObjInstance:
+		object.Class = vm.adoptObject(object.Class).(*ObjClass)
+		vm.adoptTable(&object.Fields)
+	case *ObjNative:
+		object.Name = vm.adoptObject(object.Name).(*ObjString)
+	case *ObjClosure:
+		object.Function = vm.adoptObject(object.Function).(*ObjFunction)
+		for _, upvalue := range object.Upvalues {
+			vm.adoptObject(upvalue)
+		}
+	case *ObjUpvalue:
+		*object.Location = vm.adoptValue(*object.Location)
+	case *ObjBoundMethod:
+		object.Receiver = vm.adoptValue(object.Receiver)
+		object.Method = vm.adoptObject(object.Method).(*ObjClosure)
+	case *ObjFunction:
+		// Code built outside the compiler can't be trusted to stay in bounds.
+		object.invalid = verifyFunction(object)
+		if object.Name != nil {
+			object.Name = vm.adoptObject(object.Name).(*ObjString)
+		}
+		for i := 0; i < object.Chunk.Constants.Count; i++ {
+			constant := &(*object.Chunk.Constants.Values)[i]
+			*constant = vm.adoptValue(*constant)
+		}
+	}
+
+	vm.Pop()
+	return object
+}
+
+func (vm *VM) adoptValue(value Value) Value {
+	if !value.IsObj() {
+		return value
+	}
+	return NewObjVal(vm.adoptObject(value.AsObj()))
+}
+
+// adoptTable rebuilds table in place so its keys are interned strings and
+// its values belong to the VM. The table's owner must already be rooted.
+func (vm *VM) adoptTable(table *Table) {
+	entries := make([]Entry, 0, table.Count)
+	for i := 0; i < table.capacity; i++ {
+		if table.Entries[i].Key != nil {
+			entries = append(entries, table.Entries[i])
+		}
+	}
+
+	table.Init()
+	for _, entry := range entries {
+		key := vm.copyString(string(entry.Key.Chars))
+		vm.Push(NewObjVal(key))
+		table.Set(key, vm.adoptValue(entry.Value))
+		vm.Pop()
+	}
+}
+
+func (vm *VM) getHostProperty(host *ObjHost, name *ObjString) (Value, error) {
+	property := string(name.Chars)
+	value := host.Value
+
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		switch property {
+		case "length":
+			return NewNumberVal(float64(value.Len())), nil
+		case "get":
+			return vm.hostNative(name, 1, func(args []Value) (Value, error) {
+				return hostIndex(value, args[0])
+			}), nil
+		}
+	case reflect.Pointer:
+		if field := value.Elem().FieldByName(property); field.IsValid() && field.CanInterface() {
+			return FromGo(field.Interface(), AsHostObject())
+		}
+
+		if method := value.MethodByName(property); method.IsValid() {
+			arity := method.Type().NumIn()
+			if method.Type().IsVariadic() {
+				arity = -1
+			}
+			return vm.hostNative(name, arity, func(args []Value) (Value, error) {
+				return callHostMethod(method, args)
+			}), nil
+		}
+	}
+
+	return NewNilVal(), fmt.Errorf("Undefined property '%s'.", property)
+}
+
+func (vm *VM) setHostProperty(host *ObjHost, name *ObjString, value Value) error {
+	property := string(name.Chars)
+
+	if host.Value.Kind() != reflect.Pointer {
+		return fmt.Errorf("Can't set property '%s' on %s.", property, host.Value.Type())
+	}
+
+	field := host.Value.Elem().FieldByName(property)
+	if !field.IsValid() || !field.CanSet() {
+		return fmt.Errorf("Undefined property '%s'.", property)
+	}
+
+	goValue, err := toGoType(value, field.Type())
+	if err != nil {
+		return fmt.Errorf("Can't set property '%s': %s.", property, err)
+	}
+
+	field.Set(goValue)
+	return nil
+}
+
+func (vm *VM) hostNative(name *ObjString, arity int, function func(args []Value) (Value, error)) Value {
+	native := ALLOCATE_OBJ(vm, NewObjNative(name, arity, func(vm *VM, args []Value) (Value, error) {
+		return function(args)
+	}))
+	return NewObjVal(native)
+}
+
+func hostIndex(collection reflect.Value, index Value) (Value, error) {
+	if collection.Kind() == reflect.Map {
+		key, err := toGoType(index, collection.Type().Key())
+		if err != nil {
+			return NewNilVal(), err
+		}
+
+		element := collection.MapIndex(key)
+		if !element.IsValid() {
+			return NewNilVal(), nil
+		}
+		return FromGo(element.Interface(), AsHostObject())
+	}
+
+	if !index.IsNumber() {
+		return NewNilVal(), errors.New("Index must be a number.")
+	}
+
+	i := int(index.AsNumber())
+	if float64(i) != index.AsNumber() || i < 0 || i >= collection.Len() {
+		return NewNilVal(), fmt.Errorf("Index %g out of range.", index.AsNumber())
+	}
+
+	return FromGo(collection.Index(i).Interface(), AsHostObject())
+}
+
+func callHostMethod(method reflect.Value, args []Value) (Value, error) {
+	methodType := method.Type()
+
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		paramType := methodType.In(min(i, methodType.NumIn()-1))
+		if methodType.IsVariadic() && i >= methodType.NumIn()-1 {
+			paramType = paramType.Elem()
+		}
+
+		goValue, err := toGoType(arg, paramType)
+		if err != nil {
+			return NewNilVal(), fmt.Errorf("Argument %d: %s.", i+1, err)
+		}
+		in[i] = goValue
+	}
+
+	if methodType.IsVariadic() && len(args) < methodType.NumIn()-1 {
+		return NewNilVal(), fmt.Errorf("Expected at least %d arguments but got %d.", methodType.NumIn()-1, len(args))
+	}
+
+	out := method.Call(in)
+
+	// A trailing error result turns into a Lox runtime error.
+	if len(out) > 0 && methodType.Out(len(out)-1) == reflect.TypeFor[error]() {
+		if err, _ := out[len(out)-1].Interface().(error); err != nil {
+			return NewNilVal(), err
+		}
+		out = out[:len(out)-1]
+	}
+
+	if len(out) == 0 {
+		return NewNilVal(), nil
+	}
+	return FromGo(out[0].Interface(), AsHostObject())
+}
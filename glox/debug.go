@@ -2,86 +2,187 @@ package glox
 
 import (
 	"fmt"
+	"io"
 )
 
 const DEBUG_TRACE_EXECUTION = false
 const DEBUG_PRINT_CODE = false
+const DEBUG_STRESS_GC = false
+const DEBUG_LOG_GC = false
 
-func (c *Chunk) DisassembleChunk(name string) {
-	fmt.Printf("== %s ==\n", name)
+func (c *Chunk) DisassembleChunk(w io.Writer, name string) {
+	fmt.Fprintf(w, "== %s ==\n", name)
 
 	for offset := 0; offset < c.Count; {
-		offset = c.DisassembleInstruction(offset)
+		offset = c.DisassembleInstruction(w, offset)
 	}
 
-	fmt.Printf("%4d    | ", c.Count)
-	simpleInstruction("OP_DONE", c.Count-1)
+	fmt.Fprintf(w, "%4d    | ", c.Count)
+	simpleInstruction(w, "OP_DONE", c.Count-1)
 }
 
-func (c *Chunk) DisassembleInstruction(offset int) int {
-	fmt.Printf("%04d ", offset)
+func (c *Chunk) DisassembleInstruction(w io.Writer, offset int) int {
+	fmt.Fprintf(w, "%04d ", offset)
 	if offset > 0 &&
 		c.GetLine(offset) == c.GetLine(offset-1) {
-		fmt.Printf("   | ")
+		fmt.Fprintf(w, "   | ")
 	} else {
-		fmt.Printf("%4d ", c.GetLine(offset))
+		fmt.Fprintf(w, "%4d ", c.GetLine(offset))
 	}
 
 	instruction := (*c.Code)[offset]
 
+	// A prefix and the instruction it widens are shown as one line.
+	width := 1
+	switch instruction {
+	case OP_WIDE:
+		width = 2
+		fmt.Fprint(w, "OP_WIDE ")
+	case OP_EXTRA_WIDE:
+		width = 3
+		fmt.Fprint(w, "OP_EXTRA_WIDE ")
+	}
+	if width > 1 {
+		offset++
+		instruction = (*c.Code)[offset]
+	}
+
 	switch instruction {
 	case OP_POP:
-		return simpleInstruction("OP_POP", offset)
+		return simpleInstruction(w, "OP_POP", offset)
 	case OP_PRINT:
-		return simpleInstruction("OP_PRINT", offset)
+		return simpleInstruction(w, "OP_PRINT", offset)
 	case OP_RETURN:
-		return simpleInstruction("OP_RETURN", offset)
-	case OP_CONSTANT_LONG:
-		return constantInstruction("OP_CONSTANT_LONG", c, offset)
+		return simpleInstruction(w, "OP_RETURN", offset)
+	case OP_CONSTANT:
+		return constantInstruction(w, "OP_CONSTANT", c, offset, width)
 	case OP_DEFINE_GLOBAL:
-		return constantInstruction("OP_DEFINE_GLOBAL", c, offset)
+		return constantInstruction(w, "OP_DEFINE_GLOBAL", c, offset, width)
 	case OP_GET_GLOBAL:
-		return constantInstruction("OP_GET_GLOBAL", c, offset)
+		return constantInstruction(w, "OP_GET_GLOBAL", c, offset, width)
+	case OP_SET_GLOBAL:
+		return constantInstruction(w, "OP_SET_GLOBAL", c, offset, width)
+	case OP_GET_LOCAL:
+		return operandInstruction(w, "OP_GET_LOCAL", c, offset, width)
+	case OP_SET_LOCAL:
+		return operandInstruction(w, "OP_SET_LOCAL", c, offset, width)
+	case OP_JUMP:
+		return jumpInstruction(w, "OP_JUMP", 1, c, offset)
+	case OP_JUMP_IF_FALSE:
+		return jumpInstruction(w, "OP_JUMP_IF_FALSE", 1, c, offset)
+	case OP_LOOP:
+		return jumpInstruction(w, "OP_LOOP", -1, c, offset)
+	case OP_CALL:
+		return operandInstruction(w, "OP_CALL", c, offset, width)
+	case OP_CLOSURE:
+		return closureInstruction(w, "OP_CLOSURE", c, offset, width)
+	case OP_GET_UPVALUE:
+		return operandInstruction(w, "OP_GET_UPVALUE", c, offset, width)
+	case OP_SET_UPVALUE:
+		return operandInstruction(w, "OP_SET_UPVALUE", c, offset, width)
+	case OP_CLOSE_UPVALUE:
+		return simpleInstruction(w, "OP_CLOSE_UPVALUE", offset)
+	case OP_CLASS:
+		return constantInstruction(w, "OP_CLASS", c, offset, width)
+	case OP_GET_PROPERTY:
+		return constantInstruction(w, "OP_GET_PROPERTY", c, offset, width)
+	case OP_SET_PROPERTY:
+		return constantInstruction(w, "OP_SET_PROPERTY", c, offset, width)
+	case OP_METHOD:
+		return constantInstruction(w, "OP_METHOD", c, offset, width)
+	case OP_INVOKE:
+		return invokeInstruction(w, "OP_INVOKE", c, offset, width)
+	case OP_INHERIT:
+		return simpleInstruction(w, "OP_INHERIT", offset)
+	case OP_GET_SUPER:
+		return constantInstruction(w, "OP_GET_SUPER", c, offset, width)
+	case OP_SUPER_INVOKE:
+		return invokeInstruction(w, "OP_SUPER_INVOKE", c, offset, width)
 	case OP_NEGATE:
-		return simpleInstruction("OP_NEGATE", offset)
+		return simpleInstruction(w, "OP_NEGATE", offset)
 	case OP_ADD:
-		return simpleInstruction("OP_ADD", offset)
+		return simpleInstruction(w, "OP_ADD", offset)
 	case OP_SUBTRACT:
-		return simpleInstruction("OP_SUBTRACT", offset)
+		return simpleInstruction(w, "OP_SUBTRACT", offset)
 	case OP_MULTIPLY:
-		return simpleInstruction("OP_MULTIPLY", offset)
+		return simpleInstruction(w, "OP_MULTIPLY", offset)
 	case OP_DIVIDE:
-		return simpleInstruction("OP_DIVIDE", offset)
+		return simpleInstruction(w, "OP_DIVIDE", offset)
 	case OP_NIL:
-		return simpleInstruction("OP_NIL", offset)
+		return simpleInstruction(w, "OP_NIL", offset)
 	case OP_FALSE:
-		return simpleInstruction("OP_FALSE", offset)
+		return simpleInstruction(w, "OP_FALSE", offset)
 	case OP_TRUE:
-		return simpleInstruction("OP_TRUE", offset)
+		return simpleInstruction(w, "OP_TRUE", offset)
 	case OP_NOT:
-		return simpleInstruction("OP_NOT", offset)
+		return simpleInstruction(w, "OP_NOT", offset)
 	case OP_EQUAL:
-		return simpleInstruction("OP_EQUAL", offset)
+		return simpleInstruction(w, "OP_EQUAL", offset)
 	case OP_GREATER:
-		return simpleInstruction("OP_GREATER", offset)
+		return simpleInstruction(w, "OP_GREATER", offset)
 	case OP_LESS:
-		return simpleInstruction("OP_LESS", offset)
+		return simpleInstruction(w, "OP_LESS", offset)
 	default:
-		fmt.Println("Unknown opcode")
+		fmt.Fprintln(w, "Unknown opcode")
 		return offset + 1
 	}
 }
 
-func simpleInstruction(name string, offset int) int {
-	fmt.Println(name)
+func simpleInstruction(w io.Writer, name string, offset int) int {
+	fmt.Fprintln(w, name)
 	return offset + 1
 }
 
-func constantInstruction(name string, c *Chunk, offset int) int {
-	constant := c.ReadConstant(offset + 1)
+func operandInstruction(w io.Writer, name string, c *Chunk, offset int, width int) int {
+	slot := c.ReadConstant(offset+1, width)
+	fmt.Fprintf(w, "%-16s %4d\n", name, slot)
+	return offset + 1 + width
+}
+
+func jumpInstruction(w io.Writer, name string, sign int, c *Chunk, offset int) int {
+	jump := int((*c.Code)[offset+1])<<8 | int((*c.Code)[offset+2])
+	fmt.Fprintf(w, "%-16s %4d -> %d\n", name, offset, offset+3+sign*jump)
+	return offset + 3
+}
+
+func constantInstruction(w io.Writer, name string, c *Chunk, offset int, width int) int {
+	constant := c.ReadConstant(offset+1, width)
+
+	fmt.Fprintf(w, "%-16s %4d '", name, constant)
+	c.Constants.Print(w, constant)
+	fmt.Fprintf(w, "'\n")
+	return offset + 1 + width
+}
+
+func invokeInstruction(w io.Writer, name string, c *Chunk, offset int, width int) int {
+	constant := c.ReadConstant(offset+1, width)
+	argCount := (*c.Code)[offset+1+width]
+
+	fmt.Fprintf(w, "%-16s (%d args) %4d '", name, argCount, constant)
+	c.Constants.Print(w, constant)
+	fmt.Fprintf(w, "'\n")
+	return offset + 2 + width
+}
+
+func closureInstruction(w io.Writer, name string, c *Chunk, offset int, width int) int {
+	constant := c.ReadConstant(offset+1, width)
+	offset += 1 + width
+
+	fmt.Fprintf(w, "%-16s %4d ", name, constant)
+	c.Constants.Print(w, constant)
+	fmt.Fprintf(w, "\n")
+
+	function := (*c.Constants.Values)[constant].AsFunction()
+	for j := 0; j < function.UpvalueCount; j++ {
+		isLocal := (*c.Code)[offset]
+		index := (*c.Code)[offset+1]
+		kind := "upvalue"
+		if isLocal == 1 {
+			kind = "local"
+		}
+		fmt.Fprintf(w, "%04d      |                     %s %d\n", offset, kind, index)
+		offset += 2
+	}
 
-	fmt.Printf("%-16s %4d '", name, constant)
-	c.Constants.Print(int(constant))
-	fmt.Printf("'\n")
-	return offset + 4
+	return offset
 }
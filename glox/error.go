@@ -0,0 +1,148 @@
+package glox
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// StackFrame is one active call at the moment a runtime error occurred.
+type StackFrame struct {
+	// Function is the function's name, or "script" for top-level code.
+	Function string
+	Line     int
+}
+
+type RuntimeError struct {
+	Message string
+	Line    int
+	// Column is 1-based, or 0 when the chunk carries no column information.
+	Column int
+	// Trace lists the active calls, innermost first.
+	Trace []StackFrame
+
+	snippet string
+}
+
+func (e *RuntimeError) Error() string {
+	var builder strings.Builder
+	builder.WriteString(e.Message)
+	if e.snippet != "" {
+		builder.WriteString("\n")
+		builder.WriteString(e.snippet)
+	}
+
+	for _, frame := range e.Trace {
+		fmt.Fprintf(&builder, "\n[line %d] in ", frame.Line)
+		if frame.Function == "script" {
+			builder.WriteString("script")
+		} else {
+			fmt.Fprintf(&builder, "%s()", frame.Function)
+		}
+	}
+
+	return builder.String()
+}
+
+type Severity byte
+
+const (
+	SEVERITY_ERROR Severity = iota
+	SEVERITY_WARNING
+)
+
+func (severity Severity) String() string {
+	if severity == SEVERITY_WARNING {
+		return "Warning"
+	}
+	return "Error"
+}
+
+type CompileError struct {
+	Line int
+	// Column is 1-based and counts bytes from the start of the line.
+	Column int
+	Offset int
+	// Lexeme is the offending token's source text, empty at end of input.
+	Lexeme   string
+	Message  string
+	Severity Severity
+
+	tokenType TokenType
+	snippet   string
+}
+
+func (e CompileError) Error() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "[line %d] %s", e.Line, e.Severity)
+
+	if e.tokenType == TOKEN_EOF {
+		builder.WriteString(" at end")
+	} else if e.tokenType == TOKEN_ERROR {
+		// Nothing.
+	} else {
+		fmt.Fprintf(&builder, " at '%s'", e.Lexeme)
+	}
+
+	fmt.Fprintf(&builder, ": %s", e.Message)
+	if e.snippet != "" {
+		builder.WriteString("\n")
+		builder.WriteString(e.snippet)
+	}
+	return builder.String()
+}
+
+// CompileErrors is returned by Interpret when source fails to compile.
+type CompileErrors []CompileError
+
+func (errs CompileErrors) Error() string {
+	var builder strings.Builder
+	PrintCompileErrors(&builder, errs)
+	return strings.TrimSuffix(builder.String(), "\n")
+}
+
+// PrintCompileErrors writes errs to w one per line, in the clox format.
+func PrintCompileErrors(w io.Writer, errs []CompileError) {
+	for _, err := range errs {
+		fmt.Fprintln(w, err.Error())
+	}
+}
+
+// renderSpan returns the source line holding span with a caret underline
+// beneath it, or "" if there is nothing useful to show.
+func renderSpan(source string, span Span) string {
+	if span.Line == 0 || span.Column == 0 || span.Offset > len(source) || span.Column-1 > span.Offset {
+		return ""
+	}
+
+	lineStart := span.Offset - (span.Column - 1)
+	lineEnd := len(source)
+	if i := strings.IndexByte(source[span.Offset:], '\n'); i >= 0 {
+		lineEnd = span.Offset + i
+	}
+
+	text := strings.TrimRight(source[lineStart:lineEnd], "\r")
+	if strings.TrimSpace(text) == "" {
+		return ""
+	}
+
+	var builder strings.Builder
+	builder.WriteString("    ")
+	builder.WriteString(text)
+	builder.WriteString("\n    ")
+
+	// Copy tabs from the indentation so the caret lines up with the text.
+	for _, c := range source[lineStart:span.Offset] {
+		if c == '\t' {
+			builder.WriteByte('\t')
+		} else {
+			builder.WriteByte(' ')
+		}
+	}
+	builder.WriteByte('^')
+	for i := 1; i < min(span.Length, lineEnd-span.Offset); i++ {
+		builder.WriteByte('~')
+	}
+
+	return builder.String()
+}
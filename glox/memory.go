@@ -1,5 +1,10 @@
 package glox
 
+import (
+	"fmt"
+	"unsafe"
+)
+
 func GROW_CAPACITY(capacity int) int {
 	if capacity < 8 {
 		return 8
@@ -18,3 +23,217 @@ func GROW_ARRAY[T any](array *[]T, capacity int) *[]T {
 	}
 	return &newCode
 }
+
+const (
+	GC_HEAP_GROW_FACTOR = 2
+	GC_INITIAL_HEAP     = 1024 * 1024
+)
+
+func ALLOCATE_OBJ[T Obj](vm *VM, object T) T {
+	size := objectSize(object)
+	vm.bytesAllocated += size
+
+	if DEBUG_STRESS_GC {
+		vm.CollectGarbage()
+	} else if vm.bytesAllocated > vm.nextGC {
+		vm.CollectGarbage()
+	}
+
+	object.header().owner = vm
+	vm.Objects = append(vm.Objects, object)
+
+	if DEBUG_LOG_GC {
+		fmt.Fprintf(vm.stderr, "%p allocate %d for %d\n", any(object), size, object.GetObjType())
+	}
+
+	return object
+}
+
+func objectSize(object Obj) int {
+	switch object := object.(type) {
+	case *ObjString:
+		return int(unsafe.Sizeof(*object)) + len(object.Chars)
+	case *ObjFunction:
+		return int(unsafe.Sizeof(*object))
+	case *ObjClosure:
+		return int(unsafe.Sizeof(*object)) + len(object.Upvalues)*int(unsafe.Sizeof(object))
+	case *ObjUpvalue:
+		return int(unsafe.Sizeof(*object))
+	case *ObjClass:
+		return int(unsafe.Sizeof(*object))
+	case *ObjInstance:
+		return int(unsafe.Sizeof(*object))
+	case *ObjBoundMethod:
+		return int(unsafe.Sizeof(*object))
+	case *ObjNative:
+		return int(unsafe.Sizeof(*object))
+	case *ObjHost:
+		return int(unsafe.Sizeof(*object))
+	}
+	return 0
+}
+
+func (vm *VM) markObject(object Obj) {
+	// Objects the VM never adopted are not ours to collect.
+	if object.header().isMarked || object.header().owner != vm {
+		return
+	}
+
+	if DEBUG_LOG_GC {
+		fmt.Fprintf(vm.stderr, "%p mark ", object)
+		PrintValue(vm.stderr, NewObjVal(object))
+		fmt.Fprintf(vm.stderr, "\n")
+	}
+
+	object.header().isMarked = true
+	vm.grayStack = append(vm.grayStack, object)
+}
+
+func (vm *VM) markValue(value Value) {
+	if value.IsObj() {
+		vm.markObject(value.AsObj())
+	}
+}
+
+func (vm *VM) markArray(array *valueArray) {
+	for i := 0; i < array.Count; i++ {
+		vm.markValue((*array.Values)[i])
+	}
+}
+
+func (vm *VM) markTable(table *Table) {
+	for i := 0; i < table.capacity; i++ {
+		entry := &table.Entries[i]
+		if entry.Key != nil {
+			vm.markObject(entry.Key)
+		}
+		vm.markValue(entry.Value)
+	}
+}
+
+func (vm *VM) markCompilerRoots() {
+	if vm.compiler == nil {
+		return
+	}
+
+	functionCompiler := vm.compiler.functionCompiler
+	for functionCompiler != nil {
+		vm.markObject(functionCompiler.function)
+		functionCompiler = functionCompiler.enclosing
+	}
+}
+
+func (vm *VM) markRoots() {
+	for slot := 0; slot < vm.stackTop; slot++ {
+		vm.markValue(vm.stack[slot])
+	}
+
+	for i := 0; i < vm.frameCount; i++ {
+		vm.markObject(vm.frames[i].closure)
+	}
+
+	for upvalue := vm.openUpvalues; upvalue != nil; upvalue = upvalue.Next {
+		vm.markObject(upvalue)
+	}
+
+	vm.markTable(&vm.globals)
+	vm.markCompilerRoots()
+	if vm.initString != nil {
+		vm.markObject(vm.initString)
+	}
+}
+
+func (vm *VM) blackenObject(object Obj) {
+	if DEBUG_LOG_GC {
+		fmt.Fprintf(vm.stderr, "%p blacken ", object)
+		PrintValue(vm.stderr, NewObjVal(object))
+		fmt.Fprintf(vm.stderr, "\n")
+	}
+
+	switch object := object.(type) {
+	case *ObjBoundMethod:
+		vm.markValue(object.Receiver)
+		vm.markObject(object.Method)
+	case *ObjClass:
+		vm.markObject(object.Name)
+		vm.markTable(&object.Methods)
+	case *ObjClosure:
+		vm.markObject(object.Function)
+		for _, upvalue := range object.Upvalues {
+			if upvalue != nil {
+				vm.markObject(upvalue)
+			}
+		}
+	case *ObjFunction:
+		if object.Name != nil {
+			vm.markObject(object.Name)
+		}
+		vm.markArray(&object.Chunk.Constants)
+	case *ObjInstance:
+		vm.markObject(object.Class)
+		vm.markTable(&object.Fields)
+	case *ObjNative:
+		vm.markObject(object.Name)
+	case *ObjUpvalue:
+		vm.markValue(object.Closed)
+	case *ObjString, *ObjHost:
+		// Strings and host objects hold no Lox references.
+	}
+}
+
+func (vm *VM) traceReferences() {
+	for len(vm.grayStack) > 0 {
+		object := vm.grayStack[len(vm.grayStack)-1]
+		vm.grayStack = vm.grayStack[:len(vm.grayStack)-1]
+		vm.blackenObject(object)
+	}
+}
+
+func (vm *VM) sweep() {
+	reachable := vm.Objects[:0]
+	for _, object := range vm.Objects {
+		if object.header().isMarked {
+			object.header().isMarked = false
+			reachable = append(reachable, object)
+			continue
+		}
+
+		if DEBUG_LOG_GC {
+			fmt.Fprintf(vm.stderr, "%p free type %d\n", object, object.GetObjType())
+		}
+		vm.bytesAllocated -= objectSize(object)
+		// The host may still hold the object and hand it back; it then has
+		// to be adopted, and a string interned, all over again.
+		object.header().owner = nil
+	}
+
+	// Drop the references left behind in the tail so Go can reclaim them.
+	for i := len(reachable); i < len(vm.Objects); i++ {
+		vm.Objects[i] = nil
+	}
+	vm.Objects = reachable
+}
+
+func (vm *VM) CollectGarbage() {
+	var before int
+	if DEBUG_LOG_GC {
+		fmt.Fprintf(vm.stderr, "-- gc begin\n")
+		before = vm.bytesAllocated
+	}
+
+	vm.markRoots()
+	vm.traceReferences()
+	vm.strings.removeWhite()
+	vm.sweep()
+
+	vm.nextGC = vm.bytesAllocated * GC_HEAP_GROW_FACTOR
+	if vm.nextGC < GC_INITIAL_HEAP {
+		vm.nextGC = GC_INITIAL_HEAP
+	}
+
+	if DEBUG_LOG_GC {
+		fmt.Fprintf(vm.stderr, "-- gc end\n")
+		fmt.Fprintf(vm.stderr, "   collected %d bytes (from %d to %d) next at %d\n",
+			before-vm.bytesAllocated, before, vm.bytesAllocated, vm.nextGC)
+	}
+}
@@ -0,0 +1,7 @@
+package glox
+
+import "time"
+
+func clockNative(vm *VM, args []Value) (Value, error) {
+	return NewNumberVal(float64(time.Now().UnixNano()) / float64(time.Second)), nil
+}
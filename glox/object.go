@@ -1,20 +1,44 @@
 package glox
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"reflect"
+)
 
 type ObjType uint8
 
 const (
 	OBJ_STRING ObjType = iota
+	OBJ_FUNCTION
+	OBJ_CLOSURE
+	OBJ_UPVALUE
+	OBJ_CLASS
+	OBJ_INSTANCE
+	OBJ_BOUND_METHOD
+	OBJ_NATIVE
+	OBJ_HOST
 )
 
+type ObjHeader struct {
+	isMarked bool
+	// owner is the VM whose collector the object is registered with, or
+	// nil if it was built outside any VM.
+	owner *VM
+}
+
+func (h *ObjHeader) header() *ObjHeader {
+	return h
+}
+
 type ObjString struct {
+	ObjHeader
 	Length int
 	Chars  []byte
 	Hash   uint32
 }
 
-func (o ObjString) IsEqual(other ObjString) bool {
+func (o *ObjString) IsEqual(other *ObjString) bool {
 	if o.Length != other.Length {
 		return false
 	}
@@ -24,23 +48,72 @@ func (o ObjString) IsEqual(other ObjString) bool {
 	return string(o.Chars) == string(other.Chars)
 }
 
-func (o ObjString) GetObjType() ObjType {
+func (o *ObjString) GetObjType() ObjType {
 	return OBJ_STRING
 }
 
-func (o ObjString) Print() {
-	fmt.Printf("%s", string(o.Chars))
+func (o *ObjString) Print(w io.Writer) {
+	fmt.Fprintf(w, "%s", string(o.Chars))
 }
 
 func (value *Value) IsObjValue(objType ObjType) bool {
-	return value.IsObj() && (*value.AsObj()).GetObjType() == objType
+	return value.IsObj() && value.AsObj().GetObjType() == objType
 }
 
-func AsObjString(value Obj) ObjString {
+func AsObjString(value Obj) *ObjString {
 	if v, ok := value.(*ObjString); ok {
-		return *v
+		return v
+	}
+	return nil
+}
+
+func AsObjFunction(value Obj) *ObjFunction {
+	if v, ok := value.(*ObjFunction); ok {
+		return v
+	}
+	return nil
+}
+
+func AsObjClosure(value Obj) *ObjClosure {
+	if v, ok := value.(*ObjClosure); ok {
+		return v
+	}
+	return nil
+}
+
+func AsObjClass(value Obj) *ObjClass {
+	if v, ok := value.(*ObjClass); ok {
+		return v
+	}
+	return nil
+}
+
+func AsObjInstance(value Obj) *ObjInstance {
+	if v, ok := value.(*ObjInstance); ok {
+		return v
+	}
+	return nil
+}
+
+func AsObjBoundMethod(value Obj) *ObjBoundMethod {
+	if v, ok := value.(*ObjBoundMethod); ok {
+		return v
+	}
+	return nil
+}
+
+func AsObjNative(value Obj) *ObjNative {
+	if v, ok := value.(*ObjNative); ok {
+		return v
+	}
+	return nil
+}
+
+func AsObjHost(value Obj) *ObjHost {
+	if v, ok := value.(*ObjHost); ok {
+		return v
 	}
-	return ObjString{}
+	return nil
 }
 
 func hashString(key string) uint32 {
@@ -52,11 +125,210 @@ func hashString(key string) uint32 {
 	return hash
 }
 
-func NewObjString(value string) ObjString {
+func (vm *VM) copyString(chars string) *ObjString {
+	hash := hashString(chars)
+	if interned := vm.strings.FindString(chars, hash); interned != nil {
+		return interned
+	}
+
+	str := ALLOCATE_OBJ(vm, NewObjString(chars))
+	vm.Push(NewObjVal(str))
+	vm.strings.Set(str, NewNilVal())
+	vm.Pop()
+	return str
+}
+
+func NewObjString(value string) *ObjString {
 	hash := hashString(value)
-	return ObjString{
+	return &ObjString{
 		Length: len(value),
 		Chars:  []byte(value),
 		Hash:   hash,
 	}
 }
+
+type ObjFunction struct {
+	ObjHeader
+	Arity        int
+	UpvalueCount int
+	Chunk        Chunk
+	Name         *ObjString
+	// invalid is why a function handed to the VM from outside failed
+	// Verify. Calling it is a runtime error.
+	invalid error
+	// stackSize is the most stack slots a call needs, counting the callee
+	// and its arguments, as worked out by Verify.
+	stackSize int
+}
+
+func NewObjFunction() *ObjFunction {
+	function := &ObjFunction{}
+	function.Chunk.Init()
+	return function
+}
+
+func (o *ObjFunction) GetObjType() ObjType {
+	return OBJ_FUNCTION
+}
+
+func (o *ObjFunction) Print(w io.Writer) {
+	if o.Name == nil {
+		fmt.Fprintf(w, "<script>")
+		return
+	}
+	fmt.Fprintf(w, "<fn %s>", string(o.Name.Chars))
+}
+
+type ObjUpvalue struct {
+	ObjHeader
+	Location *Value
+	Closed   Value
+	Next     *ObjUpvalue
+	// Stack slot the upvalue points at while it is still open.
+	slot int
+}
+
+func NewObjUpvalue(slot *Value, index int) *ObjUpvalue {
+	return &ObjUpvalue{
+		Location: slot,
+		Closed:   NewNilVal(),
+		Next:     nil,
+		slot:     index,
+	}
+}
+
+func (o *ObjUpvalue) GetObjType() ObjType {
+	return OBJ_UPVALUE
+}
+
+func (o *ObjUpvalue) Print(w io.Writer) {
+	fmt.Fprintf(w, "upvalue")
+}
+
+type ObjClosure struct {
+	ObjHeader
+	Function *ObjFunction
+	Upvalues []*ObjUpvalue
+}
+
+func NewObjClosure(function *ObjFunction) *ObjClosure {
+	return &ObjClosure{
+		Function: function,
+		Upvalues: make([]*ObjUpvalue, function.UpvalueCount),
+	}
+}
+
+func (o *ObjClosure) GetObjType() ObjType {
+	return OBJ_CLOSURE
+}
+
+func (o *ObjClosure) Print(w io.Writer) {
+	o.Function.Print(w)
+}
+
+type ObjClass struct {
+	ObjHeader
+	Name    *ObjString
+	Methods Table
+}
+
+func NewObjClass(name *ObjString) *ObjClass {
+	class := &ObjClass{Name: name}
+	class.Methods.Init()
+	return class
+}
+
+func (o *ObjClass) GetObjType() ObjType {
+	return OBJ_CLASS
+}
+
+func (o *ObjClass) Print(w io.Writer) {
+	fmt.Fprintf(w, "%s", string(o.Name.Chars))
+}
+
+type ObjInstance struct {
+	ObjHeader
+	Class  *ObjClass
+	Fields Table
+}
+
+func NewObjInstance(class *ObjClass) *ObjInstance {
+	instance := &ObjInstance{Class: class}
+	instance.Fields.Init()
+	return instance
+}
+
+func (o *ObjInstance) GetObjType() ObjType {
+	return OBJ_INSTANCE
+}
+
+func (o *ObjInstance) Print(w io.Writer) {
+	fmt.Fprintf(w, "%s instance", string(o.Class.Name.Chars))
+}
+
+type ObjBoundMethod struct {
+	ObjHeader
+	Receiver Value
+	Method   *ObjClosure
+}
+
+func NewObjBoundMethod(receiver Value, method *ObjClosure) *ObjBoundMethod {
+	return &ObjBoundMethod{
+		Receiver: receiver,
+		Method:   method,
+	}
+}
+
+func (o *ObjBoundMethod) GetObjType() ObjType {
+	return OBJ_BOUND_METHOD
+}
+
+func (o *ObjBoundMethod) Print(w io.Writer) {
+	o.Method.Function.Print(w)
+}
+
+// NativeFn is a Go function callable from Lox. A non-nil error aborts the
+// script with a runtime error carrying the error's message.
+type NativeFn func(vm *VM, args []Value) (Value, error)
+
+type ObjNative struct {
+	ObjHeader
+	Name *ObjString
+	// Arity is the exact number of arguments, or -1 to accept any number.
+	Arity    int
+	Function NativeFn
+}
+
+func NewObjNative(name *ObjString, arity int, function NativeFn) *ObjNative {
+	return &ObjNative{
+		Name:     name,
+		Arity:    arity,
+		Function: function,
+	}
+}
+
+func (o *ObjNative) GetObjType() ObjType {
+	return OBJ_NATIVE
+}
+
+func (o *ObjNative) Print(w io.Writer) {
+	fmt.Fprintf(w, "<native fn>")
+}
+
+// ObjHost exposes a Go value to Lox, see FromGo.
+type ObjHost struct {
+	ObjHeader
+	Value reflect.Value
+}
+
+func NewObjHost(value reflect.Value) *ObjHost {
+	return &ObjHost{Value: value}
+}
+
+func (o *ObjHost) GetObjType() ObjType {
+	return OBJ_HOST
+}
+
+func (o *ObjHost) Print(w io.Writer) {
+	fmt.Fprintf(w, "<host %s>", o.Value.Type())
+}
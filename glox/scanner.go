@@ -6,16 +6,20 @@ type Scanner struct {
 	current int
 	length  int
 	line    int
+	// column is the 1-based column of current.
+	column int
+	// startLine and startColumn locate start.
+	startLine   int
+	startColumn int
 }
 
-var scanner Scanner
-
 func (scanner *Scanner) initScanner(source string) {
 	scanner.source = source
 	scanner.length = len(source)
 	scanner.start = 0
 	scanner.current = 0
 	scanner.line = 1
+	scanner.column = 1
 }
 
 func (scanner *Scanner) isAtEnd() bool {
@@ -28,7 +32,8 @@ func (scanner *Scanner) makeToken(tokenType TokenType) Token {
 	token.tokenType = tokenType
 	token.start = scanner.start
 	token.length = scanner.current - scanner.start
-	token.line = scanner.line
+	token.line = scanner.startLine
+	token.column = scanner.startColumn
 	token.value = scanner.source[scanner.start:scanner.current]
 
 	return token
@@ -39,8 +44,10 @@ func (scanner *Scanner) errorToken(err string) Token {
 
 	token.tokenType = TOKEN_ERROR
 	token.value = err
-	token.start = 0
-	token.line = scanner.line
+	token.start = scanner.start
+	token.length = scanner.current - scanner.start
+	token.line = scanner.startLine
+	token.column = scanner.startColumn
 
 	return token
 }
@@ -56,7 +63,6 @@ func (scanner *Scanner) skipWhitespace() {
 		case ' ', '\r', '\t':
 			scanner.advance()
 		case '\n':
-			scanner.line += 1
 			scanner.advance()
 		case '/':
 			if scanner.peekNext() == '/' {
@@ -75,9 +81,6 @@ func (scanner *Scanner) skipWhitespace() {
 
 func (scanner *Scanner) string() Token {
 	for scanner.peek() != '"' && !scanner.isAtEnd() {
-		if scanner.peek() == '\n' {
-			scanner.line += 1
-		}
 		scanner.advance()
 	}
 
@@ -124,6 +127,10 @@ func (scanner *Scanner) identifier() Token {
 }
 
 func (scanner *Scanner) checkKeyword(start, end int, last string, tokenType TokenType) TokenType {
+	if scanner.current-scanner.start != end {
+		return TOKEN_IDENTIFIER
+	}
+
 	got := scanner.source[scanner.start+start : scanner.start+end]
 	if got == last {
 		return tokenType
@@ -160,20 +167,20 @@ func (scanner *Scanner) identifierType() TokenType {
 		if scanner.current-scanner.start > 1 {
 			switch scanner.source[scanner.start+1] {
 			case 'a':
-				return scanner.checkKeyword(2, 3, "lse", TOKEN_FALSE)
+				return scanner.checkKeyword(2, 5, "lse", TOKEN_FALSE)
 			case 'o':
-				return scanner.checkKeyword(2, 2, "or", TOKEN_FOR)
+				return scanner.checkKeyword(2, 3, "r", TOKEN_FOR)
 			case 'u':
-				return scanner.checkKeyword(2, 2, "un", TOKEN_FUN)
+				return scanner.checkKeyword(2, 3, "n", TOKEN_FUN)
 			}
 		}
 	case 't':
 		if scanner.current-scanner.start > 1 {
 			switch scanner.source[scanner.start+1] {
 			case 'h':
-				return scanner.checkKeyword(2, 2, "is", TOKEN_THIS)
+				return scanner.checkKeyword(2, 4, "is", TOKEN_THIS)
 			case 'r':
-				return scanner.checkKeyword(2, 2, "ue", TOKEN_TRUE)
+				return scanner.checkKeyword(2, 4, "ue", TOKEN_TRUE)
 			}
 		}
 	}
@@ -182,8 +189,16 @@ func (scanner *Scanner) identifierType() TokenType {
 }
 
 func (scanner *Scanner) advance() byte {
+	c := scanner.source[scanner.current]
 	scanner.current += 1
-	return scanner.source[scanner.current-1]
+
+	if c == '\n' {
+		scanner.line += 1
+		scanner.column = 1
+	} else {
+		scanner.column += 1
+	}
+	return c
 }
 
 func (scanner *Scanner) match(expected byte) bool {
@@ -195,7 +210,7 @@ func (scanner *Scanner) match(expected byte) bool {
 		return false
 	}
 
-	scanner.current += 1
+	scanner.advance()
 	return true
 }
 
@@ -218,6 +233,8 @@ func (scanner *Scanner) scanToken() Token {
 	scanner.skipWhitespace()
 
 	scanner.start = scanner.current
+	scanner.startLine = scanner.line
+	scanner.startColumn = scanner.column
 
 	if scanner.isAtEnd() {
 		return scanner.makeToken(TOKEN_EOF)
@@ -282,3 +299,28 @@ func (scanner *Scanner) scanToken() Token {
 
 	return scanner.errorToken("Unexpected character.")
 }
+
+// NeedsMoreInput reports whether source ends inside an unclosed bracket or
+// string, so a line-based reader should keep collecting lines before
+// interpreting it.
+func NeedsMoreInput(source string) bool {
+	scanner := &Scanner{}
+	scanner.initScanner(source)
+
+	depth := 0
+	for {
+		token := scanner.scanToken()
+		switch token.tokenType {
+		case TOKEN_LEFT_PAREN, TOKEN_LEFT_BRACE:
+			depth += 1
+		case TOKEN_RIGHT_PAREN, TOKEN_RIGHT_BRACE:
+			depth -= 1
+		case TOKEN_ERROR:
+			if token.value == "Unterminated string." {
+				return true
+			}
+		case TOKEN_EOF:
+			return depth > 0
+		}
+	}
+}
@@ -89,6 +89,39 @@ func (t *Table) Delete(key *ObjString) bool {
 	return true
 }
 
+func (t *Table) FindString(chars string, hash uint32) *ObjString {
+	if t.Count == 0 {
+		return nil
+	}
+
+	index := hash % uint32(t.capacity)
+	for {
+		entry := &t.Entries[index]
+		if entry.Key == nil {
+			// Stop if we find an empty non-tombstone entry.
+			if entry.Value.IsNil() {
+				return nil
+			}
+		} else if entry.Key.Length == len(chars) &&
+			entry.Key.Hash == hash &&
+			string(entry.Key.Chars) == chars {
+			// We found it.
+			return entry.Key
+		}
+
+		index = (index + 1) % uint32(t.capacity)
+	}
+}
+
+func (t *Table) removeWhite() {
+	for index := 0; index < t.capacity; index++ {
+		entry := &t.Entries[index]
+		if entry.Key != nil && !entry.Key.isMarked {
+			t.Delete(entry.Key)
+		}
+	}
+}
+
 func (t *Table) adjustEntries(capacity int) {
 	entries := make([]Entry, capacity)
 	for index := 0; index < capacity; index++ {
@@ -133,8 +166,7 @@ func (t *Table) findEntry(entries []Entry, key *ObjString, capacity int) *Entry
 					tombstone = entry
 				}
 			}
-		}
-		if entry.Key.IsEqual(*key) {
+		} else if entry.Key == key {
 			return entry
 		}
 
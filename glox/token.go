@@ -55,5 +55,25 @@ type Token struct {
 	value     string
 	start     int
 	length    int
-	line      int
+	// line and column are 1-based and locate the token's first character.
+	line   int
+	column int
+}
+
+// Span locates a run of source text. Line and Column are 1-based and refer
+// to the first byte; the zero Span means the location is unknown.
+type Span struct {
+	Offset int
+	Length int
+	Line   int
+	Column int
+}
+
+func (token *Token) span() Span {
+	return Span{
+		Offset: token.start,
+		Length: token.length,
+		Line:   token.line,
+		Column: token.column,
+	}
 }
@@ -1,6 +1,9 @@
 package glox
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+)
 
 type ValueType uint8
 
@@ -13,75 +16,119 @@ const (
 
 type Obj interface {
 	GetObjType() ObjType
-	Print()
+	Print(w io.Writer)
+	header() *ObjHeader
 }
 
+// Value is stored unboxed: only the field matching Type is meaningful, and
+// numbers and booleans never touch the heap.
 type Value struct {
-	Type ValueType
-	As   ValueData
-}
-
-type ValueData struct {
-	Bool   *bool
-	Number *float64
-	Obj    *Obj
+	Type    ValueType
+	boolean bool
+	number  float64
+	obj     Obj
 }
 
 func NewBoolVal(value bool) Value {
-	return Value{
-		Type: VAL_BOOL,
-		As: ValueData{
-			Bool: &value,
-		},
-	}
+	return Value{Type: VAL_BOOL, boolean: value}
 }
 
 func NewNilVal() Value {
-	return Value{
-		Type: VAL_NIL,
-		As:   ValueData{},
-	}
+	return Value{Type: VAL_NIL}
 }
 
 func NewNumberVal(value float64) Value {
-	return Value{
-		Type: VAL_NUMBER,
-		As: ValueData{
-			Number: &value,
-		},
-	}
+	return Value{Type: VAL_NUMBER, number: value}
 }
 
 func NewObjVal(value Obj) Value {
-	return Value{
-		Type: VAL_OBJ,
-		As: ValueData{
-			Obj: &value,
-		},
-	}
+	return Value{Type: VAL_OBJ, obj: value}
+}
+
+// Nil, Bool, Number and String build values to pass into the VM from Go.
+// Strings are interned by the VM when they are handed to it.
+func Nil() Value {
+	return NewNilVal()
 }
 
-func (val Value) AsBool() *bool {
-	return val.As.Bool
+func Bool(value bool) Value {
+	return NewBoolVal(value)
 }
 
-func (val Value) AsNumber() *float64 {
-	return val.As.Number
+func Number(value float64) Value {
+	return NewNumberVal(value)
 }
 
-func (val Value) AsObj() *Obj {
-	return val.As.Obj
+func String(value string) Value {
+	return NewObjVal(NewObjString(value))
+}
+
+func (val Value) AsBool() bool {
+	return val.boolean
+}
+
+func (val Value) AsNumber() float64 {
+	return val.number
+}
+
+func (val Value) AsObj() Obj {
+	return val.obj
 }
 
 func (val Value) AsString() *ObjString {
 	if val.Type != VAL_OBJ {
 		return nil
 	}
-	objString := *val.As.Obj
-	if v, ok := objString.(ObjString); ok {
-		return &v
+	return AsObjString(val.obj)
+}
+
+func (val Value) AsFunction() *ObjFunction {
+	if val.Type != VAL_OBJ {
+		return nil
+	}
+	return AsObjFunction(val.obj)
+}
+
+func (val Value) AsClosure() *ObjClosure {
+	if val.Type != VAL_OBJ {
+		return nil
+	}
+	return AsObjClosure(val.obj)
+}
+
+func (val Value) AsClass() *ObjClass {
+	if val.Type != VAL_OBJ {
+		return nil
+	}
+	return AsObjClass(val.obj)
+}
+
+func (val Value) AsInstance() *ObjInstance {
+	if val.Type != VAL_OBJ {
+		return nil
+	}
+	return AsObjInstance(val.obj)
+}
+
+func (val Value) AsBoundMethod() *ObjBoundMethod {
+	if val.Type != VAL_OBJ {
+		return nil
 	}
-	return nil
+	return AsObjBoundMethod(val.obj)
+}
+
+func (val Value) AsNative() *ObjNative {
+	if val.Type != VAL_OBJ {
+		return nil
+	}
+	return AsObjNative(val.obj)
+}
+
+func (val Value) AsHost() *ObjHost {
+	if val.Type != VAL_OBJ {
+		return nil
+	}
+	return AsObjHost(val.obj)
 }
 
 func (val Value) IsBool() bool {
@@ -101,7 +148,35 @@ func (val Value) IsObj() bool {
 }
 
 func (val Value) IsString() bool {
-	return val.Type == VAL_OBJ && (*val.AsObj()).GetObjType() == OBJ_STRING
+	return val.Type == VAL_OBJ && val.AsObj().GetObjType() == OBJ_STRING
+}
+
+func (val Value) IsFunction() bool {
+	return val.Type == VAL_OBJ && val.AsObj().GetObjType() == OBJ_FUNCTION
+}
+
+func (val Value) IsClosure() bool {
+	return val.Type == VAL_OBJ && val.AsObj().GetObjType() == OBJ_CLOSURE
+}
+
+func (val Value) IsClass() bool {
+	return val.Type == VAL_OBJ && val.AsObj().GetObjType() == OBJ_CLASS
+}
+
+func (val Value) IsInstance() bool {
+	return val.Type == VAL_OBJ && val.AsObj().GetObjType() == OBJ_INSTANCE
+}
+
+func (val Value) IsBoundMethod() bool {
+	return val.Type == VAL_OBJ && val.AsObj().GetObjType() == OBJ_BOUND_METHOD
+}
+
+func (val Value) IsNative() bool {
+	return val.Type == VAL_OBJ && val.AsObj().GetObjType() == OBJ_NATIVE
+}
+
+func (val Value) IsHost() bool {
+	return val.Type == VAL_OBJ && val.AsObj().GetObjType() == OBJ_HOST
 }
 
 type valueArray struct {
@@ -147,48 +222,31 @@ func (a Value) IsEqual(b Value) bool {
 	case VAL_NIL:
 		return true
 	case VAL_BOOL:
-		return *a.AsBool() == *b.AsBool()
+		return a.AsBool() == b.AsBool()
 	case VAL_NUMBER:
-		return *a.AsNumber() == *b.AsNumber()
+		return a.AsNumber() == b.AsNumber()
 	case VAL_OBJ:
-		aObj := *a.AsObj()
-		bObj := *b.AsObj()
-
-		if aObj == nil && bObj == nil {
-			return true
-		}
-		if aObj.GetObjType() != bObj.GetObjType() {
-			return false
-		}
-
-		switch aObj.GetObjType() {
-		case OBJ_STRING:
-			aObjStr := AsObjString(aObj)
-			bObjStr := AsObjString(bObj)
-
-			return string(aObjStr.Chars) == string(bObjStr.Chars)
-		}
-
-		return false
+		// Strings are interned, so every object compares by identity.
+		return a.AsObj() == b.AsObj()
 	default:
 		return false
 	}
 }
 
-func (v *valueArray) Print(index int) {
-	PrintValue((*v.Values)[index])
+func (v *valueArray) Print(w io.Writer, index int) {
+	PrintValue(w, (*v.Values)[index])
 }
 
-func PrintValue(value Value) {
+func PrintValue(w io.Writer, value Value) {
 	switch value.Type {
 
 	case VAL_NIL:
-		fmt.Printf("nil")
+		fmt.Fprintf(w, "nil")
 	case VAL_NUMBER:
-		fmt.Printf("%g", *value.AsNumber())
+		fmt.Fprintf(w, "%g", value.AsNumber())
 	case VAL_BOOL:
-		fmt.Printf("%v", *value.AsBool())
+		fmt.Fprintf(w, "%v", value.AsBool())
 	case VAL_OBJ:
-		(*value.AsObj()).Print()
+		value.AsObj().Print(w)
 	}
 }
@@ -0,0 +1,347 @@
+package glox
+
+import "fmt"
+
+// VerifyError describes the first problem Verify found in a chunk.
+type VerifyError struct {
+	// Function is the name of the function whose chunk is invalid, or
+	// "script" for top-level code.
+	Function string
+	Offset   int
+	Message  string
+	// overflow is set when the chunk is only invalid because it needs
+	// more stack than a frame gets.
+	overflow bool
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("invalid bytecode in %s at offset %d: %s", e.Function, e.Offset, e.Message)
+}
+
+// Verify checks that a top-level script chunk, and the chunks of every
+// function in its constant pool, only use valid opcodes with complete
+// operands, only reference constants of the right type, only jump to the
+// start of an instruction, and keep the stack within the slots the VM
+// reserves for each call frame. A chunk that passes can't make the VM read
+// outside its code, its constants or its stack.
+func Verify(chunk *Chunk) error {
+	function := &ObjFunction{Chunk: *chunk}
+	return verifyAll(function)
+}
+
+func verifyAll(function *ObjFunction) error {
+	if err := verifyFunction(function); err != nil {
+		return err
+	}
+
+	for i := 0; i < function.Chunk.Constants.Count; i++ {
+		if nested := (*function.Chunk.Constants.Values)[i].AsFunction(); nested != nil {
+			if err := verifyAll(nested); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type verifier struct {
+	function *ObjFunction
+	chunk    *Chunk
+	// starts marks the offsets where an instruction begins.
+	starts []bool
+	// heights is the stack height, counted from the frame's first slot,
+	// before the instruction at each offset, or -1 if not yet reached.
+	heights []int
+}
+
+// verifyFunction checks function's own chunk. Functions nested in its
+// constant pool are left to the caller.
+func verifyFunction(function *ObjFunction) error {
+	verifier := &verifier{
+		function: function,
+		chunk:    &function.Chunk,
+		starts:   make([]bool, function.Chunk.Count),
+		heights:  make([]int, function.Chunk.Count),
+	}
+
+	if err := verifier.decode(); err != nil {
+		return err
+	}
+	return verifier.trace()
+}
+
+func (verifier *verifier) error(offset int, format string, a ...any) *VerifyError {
+	return &VerifyError{
+		Function: functionName(verifier.function),
+		Offset:   offset,
+		Message:  fmt.Sprintf(format, a...),
+	}
+}
+
+func (verifier *verifier) code(offset int) byte {
+	return (*verifier.chunk.Code)[offset]
+}
+
+// instruction looks past any prefix on the instruction at offset, returning
+// its opcode, the offset of its first operand and that operand's width.
+func (verifier *verifier) instruction(offset int) (instruction byte, operand int, width int) {
+	instruction = verifier.code(offset)
+	width = 1
+	switch instruction {
+	case OP_WIDE:
+		width = 2
+	case OP_EXTRA_WIDE:
+		width = 3
+	}
+	if width > 1 {
+		offset++
+		instruction = verifier.code(offset)
+	}
+	return instruction, offset + 1, width
+}
+
+// widenable reports whether instruction has an operand a prefix can widen.
+func widenable(instruction byte) bool {
+	switch instruction {
+	case OP_CONSTANT, OP_DEFINE_GLOBAL, OP_GET_GLOBAL, OP_SET_GLOBAL, OP_GET_LOCAL,
+		OP_SET_LOCAL, OP_GET_UPVALUE, OP_SET_UPVALUE, OP_CALL, OP_CLOSURE, OP_CLASS,
+		OP_GET_PROPERTY, OP_SET_PROPERTY, OP_METHOD, OP_INVOKE, OP_GET_SUPER,
+		OP_SUPER_INVOKE:
+		return true
+	default:
+		return false
+	}
+}
+
+// length returns the size of the instruction at offset, prefix and operands
+// included.
+func (verifier *verifier) length(offset int) int {
+	instruction, operand, width := verifier.instruction(offset)
+	switch instruction {
+	case OP_CONSTANT, OP_DEFINE_GLOBAL, OP_GET_GLOBAL, OP_SET_GLOBAL,
+		OP_CLASS, OP_GET_PROPERTY, OP_SET_PROPERTY, OP_METHOD, OP_GET_SUPER,
+		OP_GET_LOCAL, OP_SET_LOCAL, OP_GET_UPVALUE, OP_SET_UPVALUE, OP_CALL:
+		return operand + width - offset
+	case OP_INVOKE, OP_SUPER_INVOKE:
+		return operand + width + 1 - offset
+	case OP_JUMP, OP_JUMP_IF_FALSE, OP_LOOP:
+		return 3
+	case OP_CLOSURE:
+		length := operand + width - offset
+		if offset+length <= verifier.chunk.Count {
+			if function := verifier.constant(offset).AsFunction(); function != nil {
+				length += 2 * function.UpvalueCount
+			}
+		}
+		return length
+	default:
+		return 1
+	}
+}
+
+// operand reads the first operand of the instruction at offset.
+func (verifier *verifier) operand(offset int) int {
+	_, operand, width := verifier.instruction(offset)
+	return verifier.chunk.ReadConstant(operand, width)
+}
+
+func (verifier *verifier) constant(offset int) Value {
+	index := verifier.operand(offset)
+	if index >= verifier.chunk.Constants.Count {
+		return NewNilVal()
+	}
+	return (*verifier.chunk.Constants.Values)[index]
+}
+
+// upvalues returns the offset of the first (isLocal, index) pair that follows
+// the OP_CLOSURE at offset.
+func (verifier *verifier) upvalues(offset int) int {
+	_, operand, width := verifier.instruction(offset)
+	return operand + width
+}
+
+// decode walks the instructions in order, checking everything that doesn't
+// depend on the path taken to reach them.
+func (verifier *verifier) decode() error {
+	chunk := verifier.chunk
+
+	if chunk.Count == 0 {
+		return verifier.error(0, "empty chunk")
+	}
+
+	for offset := 0; offset < chunk.Count; {
+		if prefix := verifier.code(offset); prefix > OP_EXTRA_WIDE {
+			return verifier.error(offset, "unknown opcode %d", prefix)
+		} else if prefix == OP_WIDE || prefix == OP_EXTRA_WIDE {
+			if offset+1 >= chunk.Count {
+				return verifier.error(offset, "truncated operands")
+			}
+			if next := verifier.code(offset + 1); !widenable(next) {
+				return verifier.error(offset, "opcode %d can't be widened", next)
+			}
+		}
+		instruction, _, _ := verifier.instruction(offset)
+
+		length := verifier.length(offset)
+		if offset+length > chunk.Count {
+			return verifier.error(offset, "truncated operands")
+		}
+		verifier.starts[offset] = true
+		verifier.heights[offset] = -1
+
+		switch instruction {
+		case OP_CONSTANT:
+			if index := verifier.operand(offset); index >= chunk.Constants.Count {
+				return verifier.error(offset, "constant index %d out of range", index)
+			}
+		case OP_DEFINE_GLOBAL, OP_GET_GLOBAL, OP_SET_GLOBAL, OP_CLASS, OP_GET_PROPERTY,
+			OP_SET_PROPERTY, OP_METHOD, OP_GET_SUPER, OP_INVOKE, OP_SUPER_INVOKE:
+			if !verifier.constant(offset).IsString() {
+				return verifier.error(offset, "operand is not a string constant")
+			}
+		case OP_CLOSURE:
+			function := verifier.constant(offset).AsFunction()
+			if function == nil {
+				return verifier.error(offset, "operand is not a function constant")
+			}
+			upvalues := verifier.upvalues(offset)
+			for i := 0; i < function.UpvalueCount; i++ {
+				isLocal := verifier.code(upvalues + 2*i)
+				index := int(verifier.code(upvalues + 1 + 2*i))
+				if isLocal > 1 {
+					return verifier.error(offset, "bad upvalue kind %d", isLocal)
+				}
+				if isLocal == 0 && index >= verifier.function.UpvalueCount {
+					return verifier.error(offset, "upvalue index %d out of range", index)
+				}
+			}
+		case OP_GET_UPVALUE, OP_SET_UPVALUE:
+			if index := verifier.operand(offset); index >= verifier.function.UpvalueCount {
+				return verifier.error(offset, "upvalue index %d out of range", index)
+			}
+		}
+
+		offset += length
+	}
+
+	return nil
+}
+
+// trace follows every path through the chunk, tracking the stack height to
+// catch underflow, overflow and paths that disagree about the height.
+func (verifier *verifier) trace() error {
+	maxHeight := STACK_MAX / FRAMES_MAX
+
+	if verifier.function.Arity < 0 || verifier.function.Arity+1 > maxHeight {
+		return verifier.error(0, "arity %d out of range", verifier.function.Arity)
+	}
+
+	type state struct{ offset, height int }
+	// Slot zero holds the callee, followed by the arguments.
+	worklist := []state{{0, verifier.function.Arity + 1}}
+	stackSize := verifier.function.Arity + 1
+
+	for len(worklist) > 0 {
+		current := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+		offset, height := current.offset, current.height
+
+		if verifier.heights[offset] != -1 {
+			if verifier.heights[offset] != height {
+				return verifier.error(offset, "stack height %d here disagrees with %d on another path", height, verifier.heights[offset])
+			}
+			continue
+		}
+		verifier.heights[offset] = height
+
+		instruction, _, _ := verifier.instruction(offset)
+		pops, pushes := verifier.stackEffect(offset)
+		if height < pops {
+			return verifier.error(offset, "stack underflow")
+		}
+
+		switch instruction {
+		case OP_GET_LOCAL, OP_SET_LOCAL:
+			if slot := verifier.operand(offset); slot >= height {
+				return verifier.error(offset, "local slot %d out of range", slot)
+			}
+		case OP_CLOSURE:
+			function := verifier.constant(offset).AsFunction()
+			upvalues := verifier.upvalues(offset)
+			for i := 0; i < function.UpvalueCount; i++ {
+				// A local function captures the slot its closure is about to fill.
+				isLocal := verifier.code(upvalues + 2*i)
+				if slot := int(verifier.code(upvalues + 1 + 2*i)); isLocal == 1 && slot > height {
+					return verifier.error(offset, "captured local slot %d out of range", slot)
+				}
+			}
+		}
+
+		height += pushes - pops
+		if height > maxHeight {
+			err := verifier.error(offset, "stack height exceeds %d slots", maxHeight)
+			err.overflow = true
+			return err
+		}
+		stackSize = max(stackSize, height)
+
+		next := offset + verifier.length(offset)
+		var successors []int
+		switch instruction {
+		case OP_RETURN:
+		case OP_JUMP:
+			successors = append(successors, next+verifier.jump(offset))
+		case OP_JUMP_IF_FALSE:
+			successors = append(successors, next, next+verifier.jump(offset))
+		case OP_LOOP:
+			successors = append(successors, next-verifier.jump(offset))
+		default:
+			successors = append(successors, next)
+		}
+
+		for _, successor := range successors {
+			if successor == verifier.chunk.Count && successor == next {
+				return verifier.error(offset, "execution runs past the end of the chunk")
+			}
+			if successor < 0 || successor >= verifier.chunk.Count || !verifier.starts[successor] {
+				return verifier.error(offset, "jump to %d is not the start of an instruction", successor)
+			}
+			worklist = append(worklist, state{successor, height})
+		}
+	}
+
+	verifier.function.stackSize = stackSize
+	return nil
+}
+
+func (verifier *verifier) jump(offset int) int {
+	return int(verifier.code(offset+1))<<8 | int(verifier.code(offset+2))
+}
+
+// stackEffect returns how many values the instruction at offset needs on the
+// stack and how many it leaves in their place.
+func (verifier *verifier) stackEffect(offset int) (pops, pushes int) {
+	instruction, operand, width := verifier.instruction(offset)
+	switch instruction {
+	case OP_CONSTANT, OP_NIL, OP_TRUE, OP_FALSE, OP_GET_GLOBAL, OP_GET_LOCAL,
+		OP_GET_UPVALUE, OP_CLOSURE, OP_CLASS:
+		return 0, 1
+	case OP_EQUAL, OP_GREATER, OP_LESS, OP_ADD, OP_SUBTRACT, OP_MULTIPLY, OP_DIVIDE:
+		return 2, 1
+	case OP_NEGATE, OP_NOT, OP_SET_GLOBAL, OP_SET_LOCAL, OP_SET_UPVALUE, OP_GET_PROPERTY,
+		OP_JUMP_IF_FALSE:
+		return 1, 1
+	case OP_PRINT, OP_POP, OP_DEFINE_GLOBAL, OP_CLOSE_UPVALUE, OP_RETURN:
+		return 1, 0
+	case OP_SET_PROPERTY, OP_METHOD, OP_INHERIT, OP_GET_SUPER:
+		return 2, 1
+	case OP_CALL:
+		return verifier.operand(offset) + 1, 1
+	case OP_INVOKE:
+		return int(verifier.code(operand+width)) + 1, 1
+	case OP_SUPER_INVOKE:
+		return int(verifier.code(operand+width)) + 2, 1
+	default:
+		return 0, 0
+	}
+}
@@ -0,0 +1,316 @@
+package glox
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// buildFunction builds a function whose chunk holds code and constants.
+func buildFunction(name string, upvalueCount int, code []byte, constants ...Value) *ObjFunction {
+	function := NewObjFunction()
+	if name != "" {
+		function.Name = NewObjString(name)
+	}
+	function.UpvalueCount = upvalueCount
+	for _, b := range code {
+		function.Chunk.Write(b, Span{Line: 1})
+	}
+	for _, constant := range constants {
+		function.Chunk.Constants.Write(constant)
+	}
+	return function
+}
+
+func TestVerify(t *testing.T) {
+	// A script that pushes one value too many for a frame; slot zero is
+	// taken by the script itself.
+	overflow := []byte{}
+	for i := 0; i < STACK_MAX/FRAMES_MAX; i++ {
+		overflow = append(overflow, OP_NIL)
+	}
+	overflow = append(overflow, OP_RETURN)
+
+	tests := []struct {
+		name      string
+		code      []byte
+		constants []Value
+		// function is the name of the function the error is reported in.
+		function string
+		offset   int
+		message  string
+	}{
+		{
+			name: "valid",
+			code: []byte{OP_CONSTANT, 0, OP_PRINT, OP_NIL, OP_RETURN},
+			constants: []Value{
+				NewNumberVal(1),
+			},
+		},
+		{
+			name:    "empty chunk",
+			code:    []byte{},
+			message: "empty chunk",
+		},
+		{
+			name:    "unknown opcode",
+			code:    []byte{OP_NIL, 0xff, OP_RETURN},
+			offset:  1,
+			message: "unknown opcode 255",
+		},
+		{
+			name:    "truncated operand",
+			code:    []byte{OP_NIL, OP_CONSTANT},
+			offset:  1,
+			message: "truncated operands",
+		},
+		{
+			name:      "truncated operand after a wide prefix",
+			code:      []byte{OP_WIDE, OP_CONSTANT, 0},
+			constants: []Value{NewNumberVal(1)},
+			message:   "truncated operands",
+		},
+		{
+			name:      "truncated operand after an extra wide prefix",
+			code:      []byte{OP_EXTRA_WIDE, OP_GET_GLOBAL, 0, 0},
+			constants: []Value{String("a")},
+			message:   "truncated operands",
+		},
+		{
+			name:    "prefix at the end",
+			code:    []byte{OP_NIL, OP_WIDE},
+			offset:  1,
+			message: "truncated operands",
+		},
+		{
+			name:    "prefix on an opcode without operands",
+			code:    []byte{OP_WIDE, OP_NIL, OP_RETURN},
+			message: fmt.Sprintf("opcode %d can't be widened", OP_NIL),
+		},
+		{
+			name:      "constant index equal to the count",
+			code:      []byte{OP_CONSTANT, 1, OP_RETURN},
+			constants: []Value{NewNumberVal(1)},
+			message:   "constant index 1 out of range",
+		},
+		{
+			name:      "wide constant index out of range",
+			code:      []byte{OP_WIDE, OP_CONSTANT, 1, 0, OP_RETURN},
+			constants: []Value{NewNumberVal(1)},
+			message:   "constant index 256 out of range",
+		},
+		{
+			name:      "name operand that is not a string",
+			code:      []byte{OP_GET_GLOBAL, 0, OP_RETURN},
+			constants: []Value{NewNumberVal(1)},
+			message:   "operand is not a string constant",
+		},
+		{
+			name:      "invoke of a name that is not a string",
+			code:      []byte{OP_NIL, OP_INVOKE, 0, 0, OP_RETURN},
+			constants: []Value{NewNilVal()},
+			offset:    1,
+			message:   "operand is not a string constant",
+		},
+		{
+			name:      "closure of a constant that is not a function",
+			code:      []byte{OP_CLOSURE, 0, OP_RETURN},
+			constants: []Value{String("f")},
+			message:   "operand is not a function constant",
+		},
+		{
+			name:      "jump into the middle of an instruction",
+			code:      []byte{OP_JUMP, 0, 1, OP_CONSTANT, 0, OP_RETURN},
+			constants: []Value{NewNumberVal(1)},
+			message:   "jump to 4 is not the start of an instruction",
+		},
+		{
+			name:    "jump past the end",
+			code:    []byte{OP_JUMP, 0, 10, OP_NIL, OP_RETURN},
+			message: "jump to 13 is not the start of an instruction",
+		},
+		{
+			name:    "loop before the start",
+			code:    []byte{OP_NIL, OP_LOOP, 0, 5, OP_RETURN},
+			offset:  1,
+			message: "jump to -1 is not the start of an instruction",
+		},
+		{
+			name:    "running off the end",
+			code:    []byte{OP_NIL, OP_PRINT},
+			offset:  1,
+			message: "execution runs past the end of the chunk",
+		},
+		{
+			name:    "stack underflow",
+			code:    []byte{OP_POP, OP_POP, OP_NIL, OP_RETURN},
+			offset:  1,
+			message: "stack underflow",
+		},
+		{
+			name:    "call with more arguments than the stack holds",
+			code:    []byte{OP_NIL, OP_CALL, 2, OP_RETURN},
+			offset:  1,
+			message: "stack underflow",
+		},
+		{
+			name:    "local slot out of range",
+			code:    []byte{OP_GET_LOCAL, 1, OP_RETURN},
+			message: "local slot 1 out of range",
+		},
+		{
+			// The branch skips one OP_NIL, so the paths reach offset 5 with
+			// different heights.
+			name:    "heights that disagree at a merge",
+			code:    []byte{OP_NIL, OP_JUMP_IF_FALSE, 0, 1, OP_NIL, OP_NIL, OP_RETURN},
+			offset:  5,
+			message: "stack height 3 here disagrees with 2 on another path",
+		},
+		{
+			name:    "stack overflow",
+			code:    overflow,
+			offset:  STACK_MAX/FRAMES_MAX - 1,
+			message: fmt.Sprintf("stack height exceeds %d slots", STACK_MAX/FRAMES_MAX),
+		},
+		{
+			name:    "upvalue index out of range",
+			code:    []byte{OP_GET_UPVALUE, 0, OP_RETURN},
+			message: "upvalue index 0 out of range",
+		},
+		{
+			name: "captured upvalue index out of range",
+			code: []byte{OP_CLOSURE, 0, 0, 0, OP_RETURN},
+			constants: []Value{
+				NewObjVal(buildFunction("f", 1, []byte{OP_NIL, OP_RETURN})),
+			},
+			message: "upvalue index 0 out of range",
+		},
+		{
+			name: "bad upvalue kind",
+			code: []byte{OP_CLOSURE, 0, 2, 0, OP_RETURN},
+			constants: []Value{
+				NewObjVal(buildFunction("f", 1, []byte{OP_NIL, OP_RETURN})),
+			},
+			message: "bad upvalue kind 2",
+		},
+		{
+			name: "invalid nested function",
+			code: []byte{OP_CLOSURE, 0, OP_RETURN},
+			constants: []Value{
+				NewObjVal(buildFunction("f", 0, []byte{OP_NIL, OP_POP, OP_POP, OP_POP})),
+			},
+			function: "f",
+			offset:   3,
+			message:  "stack underflow",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			script := buildFunction("", 0, test.code, test.constants...)
+			err := Verify(&script.Chunk)
+
+			if test.message == "" {
+				if err != nil {
+					t.Fatalf("Verify() = %v, want nil", err)
+				}
+				return
+			}
+
+			var verifyError *VerifyError
+			if !errors.As(err, &verifyError) {
+				t.Fatalf("Verify() = %v, want a *VerifyError", err)
+			}
+			want := test.function
+			if want == "" {
+				want = "script"
+			}
+			if verifyError.Function != want || verifyError.Offset != test.offset || verifyError.Message != test.message {
+				t.Errorf("Verify() = %v, want %q at offset %d in %s", err, test.message, test.offset, want)
+			}
+		})
+	}
+}
+
+func TestVerifyCompiledPrograms(t *testing.T) {
+	// Enough globals to need wide and extra wide constant operands.
+	var globals strings.Builder
+	for i := 0; i < 70000; i++ {
+		fmt.Fprintf(&globals, "var g%d = %d;\n", i, i)
+	}
+
+	sources := map[string]string{
+		"arithmetic": `print (1 + 2) * 3 - -4 / 2; print "a" + "b"; print !nil == true;`,
+		"control flow": `
+var total = 0;
+for (var i = 0; i < 10; i = i + 1) {
+  if (i == 5 and total > 3 or false) total = total - 1; else total = total + i;
+}
+while (total > 0) total = total - 7;
+print total;
+`,
+		"closures": `
+fun counter() {
+  var count = 0;
+  fun increment() {
+    count = count + 1;
+    fun peek() { return count; }
+    return peek;
+  }
+  return increment;
+}
+var next = counter();
+next(); print next()();
+{
+  var a = 1;
+  fun capture() { return a; }
+  a = 2;
+  print capture();
+}
+`,
+		"classes": `
+class Shape {
+  init(name) { this.name = name; }
+  describe() { return this.name + " with " + this.sides() + " sides"; }
+  sides() { return "some"; }
+}
+class Square < Shape {
+  init() { super.init("square"); }
+  sides() { return "4"; }
+  describe() { return "a " + super.describe(); }
+}
+var square = Square();
+var describe = square.describe;
+print describe();
+print square.sides();
+`,
+		"early returns": `
+fun sign(n) {
+  if (n < 0) return -1;
+  if (n > 0) { return 1; }
+  return 0;
+}
+class Empty { init() { return; } }
+print sign(-3) + sign(0) + sign(5);
+print Empty();
+`,
+		"wide operands": globals.String() + "print g69999;",
+	}
+
+	for name, source := range sources {
+		t.Run(name, func(t *testing.T) {
+			vm := NewVM()
+			vm.Init()
+			defer vm.Free()
+
+			function, errs := vm.Compile(source)
+			if errs != nil {
+				t.Fatalf("Compile failed: %v", CompileErrors(errs))
+			}
+			if err := Verify(&function.Chunk); err != nil {
+				t.Errorf("Verify() = %v", err)
+			}
+		})
+	}
+}
@@ -1,7 +1,10 @@
 package glox
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
 )
 
 type InterpretResult int
@@ -13,18 +16,22 @@ const (
 )
 
 const (
-	STACK_MAX = 256
+	FRAMES_MAX = 64
+	STACK_MAX  = FRAMES_MAX * UINT8_COUNT
 )
 
 func Concatenate(vm *VM) {
-	b := *vm.Pop().AsString()
-	a := *vm.Pop().AsString()
+	b := vm.Peek(0).AsString()
+	a := vm.Peek(1).AsString()
 
 	result := make([]byte, len(a.Chars)+len(b.Chars))
 	copy(result, a.Chars)
 	copy(result[len(a.Chars):], b.Chars)
 
-	vm.Push(NewObjVal(NewObjString(string(result))))
+	str := vm.copyString(string(result))
+	vm.Pop()
+	vm.Pop()
+	vm.Push(NewObjVal(str))
 }
 
 func BinaryOp(vm *VM, op byte) InterpretResult {
@@ -33,10 +40,14 @@ func BinaryOp(vm *VM, op byte) InterpretResult {
 		return INTERPRET_RUNTIME_ERROR
 	}
 
-	b := *vm.Pop().AsNumber()
-	a := *vm.Pop().AsNumber()
+	b := vm.Pop().AsNumber()
+	a := vm.Pop().AsNumber()
 
 	switch op {
+	case OP_GREATER:
+		vm.Push(NewBoolVal(a > b))
+	case OP_LESS:
+		vm.Push(NewBoolVal(a < b))
 	case OP_ADD:
 		vm.Push(NewNumberVal(a + b))
 	case OP_SUBTRACT:
@@ -50,61 +61,191 @@ func BinaryOp(vm *VM, op byte) InterpretResult {
 	return INTERPRET_OK
 }
 
-func Interpret(line string) InterpretResult {
-	return INTERPRET_OK
+func Interpret(source string, options ...VMOption) (InterpretResult, error) {
+	vm := NewVM(options...)
+	vm.Init()
+	defer vm.Free()
+
+	return vm.Interpret(source)
+}
+
+func InterpretBytecode(data []byte, options ...VMOption) (InterpretResult, error) {
+	vm := NewVM(options...)
+	vm.Init()
+	defer vm.Free()
+
+	return vm.InterpretBytecode(data)
+}
+
+type CallFrame struct {
+	closure *ObjClosure
+	ip      int
+	slots   int
 }
 
 type VM struct {
-	chunk    *Chunk
-	ip       int
-	stack    []Value
-	stackTop int
-	Objects  []*Obj
-	globals  Table
+	frames       [FRAMES_MAX]CallFrame
+	frameCount   int
+	stack        []Value
+	stackTop     int
+	Objects      []Obj
+	globals      Table
+	strings      Table
+	initString   *ObjString
+	openUpvalues *ObjUpvalue
+	compiler     *Compiler
+	lastError    *RuntimeError
+	// operandWidth is the size of the current instruction's first operand,
+	// set by an OP_WIDE or OP_EXTRA_WIDE prefix.
+	operandWidth int
+
+	bytesAllocated int
+	nextGC         int
+	grayStack      []Obj
+
+	stdout io.Writer
+	stderr io.Writer
+	stdin  io.Reader
+}
+
+type VMOption func(vm *VM)
+
+// WithStdout sends the output of print statements to w.
+func WithStdout(w io.Writer) VMOption {
+	return func(vm *VM) {
+		vm.stdout = w
+	}
+}
+
+// WithStderr sends diagnostics, such as disassembly, execution traces and GC
+// logs, to w.
+func WithStderr(w io.Writer) VMOption {
+	return func(vm *VM) {
+		vm.stderr = w
+	}
+}
+
+// WithStdin makes r the input that natives read through VM.Stdin.
+func WithStdin(r io.Reader) VMOption {
+	return func(vm *VM) {
+		vm.stdin = r
+	}
+}
+
+// NewVM returns a VM reading and writing the process's standard streams
+// unless options say otherwise.
+func NewVM(options ...VMOption) *VM {
+	vm := &VM{
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+		stdin:  os.Stdin,
+	}
+	for _, option := range options {
+		option(vm)
+	}
+	return vm
 }
 
-func NewVM() *VM {
-	return &VM{}
+func (vm *VM) Stdout() io.Writer {
+	return vm.stdout
+}
+
+func (vm *VM) Stderr() io.Writer {
+	return vm.stderr
+}
+
+func (vm *VM) Stdin() io.Reader {
+	return vm.stdin
 }
 
 func (vm *VM) Init() {
 	vm.stack = make([]Value, STACK_MAX)
-	vm.stackTop = 0
-	vm.Objects = make([]*Obj, 0)
+	vm.ResetStack()
+	vm.Objects = make([]Obj, 0)
+	vm.bytesAllocated = 0
+	vm.nextGC = GC_INITIAL_HEAP
+	vm.grayStack = nil
 	vm.globals.Init()
+	vm.strings.Init()
+
+	vm.initString = nil
+	vm.initString = vm.copyString("init")
+
+	vm.DefineNative("clock", 0, clockNative)
 }
 
 func (vm *VM) Free() {
 	vm.stack = nil
 	vm.Objects = nil
+	vm.grayStack = nil
+	vm.bytesAllocated = 0
 	vm.globals.Free()
+	vm.strings.Free()
+	vm.initString = nil
 }
 
-func (vm *VM) Interpret(source string) InterpretResult {
-	chunk := NewChunk()
-	chunk.Init()
+// Interpret compiles and runs source. Compile failures are returned as
+// CompileErrors and runtime failures as a *RuntimeError; the VM is reset and
+// can run further code afterwards.
+func (vm *VM) Interpret(source string) (InterpretResult, error) {
+	function, errs := vm.Compile(source)
+	if errs != nil {
+		return INTERPRET_COMPILE_ERROR, CompileErrors(errs)
+	}
 
-	if !vm.Compile(source, chunk) {
-		chunk.Free()
-		return INTERPRET_COMPILE_ERROR
+	return vm.runScript(function)
+}
+
+// InterpretBytecode runs a script compiled ahead of time with
+// Chunk.MarshalBinary. Bytecode that fails to decode or to Verify is
+// reported as a compile error.
+func (vm *VM) InterpretBytecode(data []byte) (InterpretResult, error) {
+	function := NewObjFunction()
+	if err := function.Chunk.UnmarshalBinary(data); err != nil {
+		return INTERPRET_COMPILE_ERROR, err
+	}
+	if err := Verify(&function.Chunk); err != nil {
+		return INTERPRET_COMPILE_ERROR, err
 	}
 
-	vm.chunk = chunk
-	vm.ip = 0
+	return vm.runScript(vm.adoptObject(function).(*ObjFunction))
+}
+
+func (vm *VM) runScript(function *ObjFunction) (InterpretResult, error) {
+	vm.Push(NewObjVal(function))
+	closure := ALLOCATE_OBJ(vm, NewObjClosure(function))
+	vm.Pop()
+	vm.Push(NewObjVal(closure))
+	vm.call(closure, 0)
 
 	result := vm.Run()
+	if result == INTERPRET_RUNTIME_ERROR {
+		return result, vm.lastError
+	}
+	return result, nil
+}
 
-	chunk.Free()
+// Run executes the frames on the call stack until the outermost one returns.
+func (vm *VM) Run() InterpretResult {
+	result := vm.run(0)
+	if result == INTERPRET_OK {
+		vm.Pop()
+	} else {
+		vm.ResetStack()
+	}
 	return result
 }
 
-func (vm *VM) Compile(source string, chunk *Chunk) bool {
-	scanner.initScanner(source)
+// Compile compiles source into the top-level script function. On failure it
+// returns every error found, recovering at statement boundaries after each.
+func (vm *VM) Compile(source string) (*ObjFunction, []CompileError) {
+	compiler := NewCompiler(vm, source)
 
-	compiler.complierChunk = chunk
+	// The GC walks the functions still being compiled as roots.
+	vm.compiler = compiler
+	defer func() { vm.compiler = nil }()
 
-	compiler.hadError = false
-	compiler.panicMode = false
+	compiler.beginFunction(TYPE_SCRIPT)
 
 	compiler.advance()
 
@@ -112,43 +253,264 @@ func (vm *VM) Compile(source string, chunk *Chunk) bool {
 		compiler.declaration()
 	}
 
-	compiler.endCompiler()
+	function := compiler.endCompiler(false)
+
+	if compiler.hadError {
+		return nil, compiler.errors
+	}
+	return function, nil
+}
+
+func (vm *VM) currentFrame() *CallFrame {
+	return &vm.frames[vm.frameCount-1]
+}
 
-	return !compiler.hadError
+func (vm *VM) currentChunk() *Chunk {
+	return &vm.currentFrame().closure.Function.Chunk
 }
 
 func (vm *VM) ReadByte() (byte, error) {
-	if vm.ip >= len(*vm.chunk.Code) {
+	frame := vm.currentFrame()
+	if frame.ip >= len(*frame.closure.Function.Chunk.Code) {
 		return 0, fmt.Errorf("%b", INTERPRET_COMPILE_ERROR)
 	}
-	value := (*vm.chunk.Code)[vm.ip]
-	vm.ip++
+	value := (*frame.closure.Function.Chunk.Code)[frame.ip]
+	frame.ip++
 	return value, nil
 }
 
 func (vm *VM) IsFalsy(value Value) bool {
-	return value.IsNil() || (value.IsBool() && !*value.AsBool())
+	return value.IsNil() || (value.IsBool() && !value.AsBool())
 }
 
 func (vm *VM) disassembleVM() {
-	fmt.Printf("          ")
+	fmt.Fprintf(vm.stderr, "          ")
 	for i := 0; i < vm.stackTop; i++ {
 		slot := vm.stack[i]
-		fmt.Printf("[ ")
-		PrintValue(slot)
-		fmt.Printf(" ]")
+		fmt.Fprintf(vm.stderr, "[ ")
+		PrintValue(vm.stderr, slot)
+		fmt.Fprintf(vm.stderr, " ]")
 	}
-	fmt.Printf("\n")
-	vm.chunk.DisassembleInstruction(vm.ip)
+	fmt.Fprintf(vm.stderr, "\n")
+	frame := vm.currentFrame()
+	frame.closure.Function.Chunk.DisassembleInstruction(vm.stderr, frame.ip)
 }
 
+// ReadConstant reads the current instruction's first operand, which is as
+// wide as its prefix says.
 func (vm *VM) ReadConstant() int {
-	constant := vm.chunk.ReadConstant(vm.ip)
-	vm.ip = vm.ip + 3
+	frame := vm.currentFrame()
+	constant := frame.closure.Function.Chunk.ReadConstant(frame.ip, vm.operandWidth)
+	frame.ip = frame.ip + vm.operandWidth
 	return constant
 }
 
-func (vm *VM) Run() InterpretResult {
+func (vm *VM) ReadString() *ObjString {
+	return (*vm.currentChunk().Constants.Values)[vm.ReadConstant()].AsString()
+}
+
+func (vm *VM) ReadShort() int {
+	frame := vm.currentFrame()
+	code := *frame.closure.Function.Chunk.Code
+	offset := int(code[frame.ip])<<8 | int(code[frame.ip+1])
+	frame.ip = frame.ip + 2
+	return offset
+}
+
+func (vm *VM) call(closure *ObjClosure, argCount int) bool {
+	if closure.Function.invalid != nil {
+		vm.runtimeError("Can't call function: %s.", closure.Function.invalid)
+		return false
+	}
+
+	if argCount != closure.Function.Arity {
+		vm.runtimeError("Expected %d arguments but got %d.", closure.Function.Arity, argCount)
+		return false
+	}
+
+	if vm.frameCount == FRAMES_MAX || vm.stackTop-argCount-1+closure.Function.stackSize > STACK_MAX {
+		vm.runtimeError("Stack overflow.")
+		return false
+	}
+
+	frame := &vm.frames[vm.frameCount]
+	vm.frameCount += 1
+	frame.closure = closure
+	frame.ip = 0
+	frame.slots = vm.stackTop - argCount - 1
+	return true
+}
+
+func (vm *VM) callValue(callee Value, argCount int) bool {
+	if callee.IsObj() {
+		switch callee.AsObj().GetObjType() {
+		case OBJ_BOUND_METHOD:
+			bound := callee.AsBoundMethod()
+			vm.stack[vm.stackTop-argCount-1] = bound.Receiver
+			return vm.call(bound.Method, argCount)
+		case OBJ_CLASS:
+			class := callee.AsClass()
+			vm.stack[vm.stackTop-argCount-1] = NewObjVal(ALLOCATE_OBJ(vm, NewObjInstance(class)))
+			if initializer, found := class.Methods.Get(vm.initString); found {
+				return vm.call(initializer.AsClosure(), argCount)
+			} else if argCount != 0 {
+				vm.runtimeError("Expected 0 arguments but got %d.", argCount)
+				return false
+			}
+			return true
+		case OBJ_CLOSURE:
+			return vm.call(callee.AsClosure(), argCount)
+		case OBJ_NATIVE:
+			return vm.callNative(callee.AsNative(), argCount)
+		}
+	}
+
+	vm.runtimeError("Can only call functions and classes.")
+	return false
+}
+
+func (vm *VM) callNative(native *ObjNative, argCount int) bool {
+	if native.Arity >= 0 && argCount != native.Arity {
+		vm.runtimeError("Expected %d arguments but got %d.", native.Arity, argCount)
+		return false
+	}
+
+	args := vm.stack[vm.stackTop-argCount : vm.stackTop]
+	result, err := native.Function(vm, args)
+	if err != nil {
+		// A failed nested VM.Call has already unwound its own frames.
+		var runtimeErr *RuntimeError
+		if errors.As(err, &runtimeErr) {
+			vm.runtimeError("%s", runtimeErr.Message)
+		} else {
+			vm.runtimeError("%s", err.Error())
+		}
+		return false
+	}
+
+	result, err = vm.adopt(result)
+	if err != nil {
+		vm.runtimeError("%s", err.Error())
+		return false
+	}
+
+	vm.stackTop -= argCount + 1
+	vm.Push(result)
+	return true
+}
+
+// DefineNative installs a Go function as a global callable from Lox.
+func (vm *VM) DefineNative(name string, arity int, function NativeFn) {
+	vm.Push(NewObjVal(vm.copyString(name)))
+	vm.Push(NewObjVal(ALLOCATE_OBJ(vm, NewObjNative(vm.Peek(0).AsString(), arity, function))))
+	vm.globals.Set(vm.Peek(1).AsString(), vm.Peek(0))
+	vm.Pop()
+	vm.Pop()
+}
+
+func (vm *VM) invokeFromClass(class *ObjClass, name *ObjString, argCount int) bool {
+	method, found := class.Methods.Get(name)
+	if !found {
+		vm.runtimeError("Undefined property '%s'.", name.Chars)
+		return false
+	}
+	return vm.call(method.AsClosure(), argCount)
+}
+
+func (vm *VM) invoke(name *ObjString, argCount int) bool {
+	receiver := vm.Peek(argCount)
+
+	if receiver.IsHost() {
+		value, err := vm.getHostProperty(receiver.AsHost(), name)
+		if err == nil {
+			value, err = vm.adopt(value)
+		}
+		if err != nil {
+			vm.runtimeError("%s", err.Error())
+			return false
+		}
+		vm.stack[vm.stackTop-argCount-1] = value
+		return vm.callValue(value, argCount)
+	}
+
+	if !receiver.IsInstance() {
+		vm.runtimeError("Only instances have methods.")
+		return false
+	}
+
+	instance := receiver.AsInstance()
+
+	if value, found := instance.Fields.Get(name); found {
+		vm.stack[vm.stackTop-argCount-1] = value
+		return vm.callValue(value, argCount)
+	}
+
+	return vm.invokeFromClass(instance.Class, name, argCount)
+}
+
+func (vm *VM) bindMethod(class *ObjClass, name *ObjString) bool {
+	method, found := class.Methods.Get(name)
+	if !found {
+		vm.runtimeError("Undefined property '%s'.", name.Chars)
+		return false
+	}
+
+	bound := ALLOCATE_OBJ(vm, NewObjBoundMethod(vm.Peek(0), method.AsClosure()))
+	vm.Pop()
+	vm.Push(NewObjVal(bound))
+	return true
+}
+
+func (vm *VM) defineMethod(name *ObjString) bool {
+	// The compiler never emits anything else, but loaded bytecode might.
+	if !vm.Peek(0).IsClosure() || !vm.Peek(1).IsClass() {
+		vm.runtimeError("Methods must be closures defined on a class.")
+		return false
+	}
+
+	method := vm.Peek(0)
+	class := vm.Peek(1).AsClass()
+	class.Methods.Set(name, method)
+	vm.Pop()
+	return true
+}
+
+func (vm *VM) captureUpvalue(slot int) *ObjUpvalue {
+	var prevUpvalue *ObjUpvalue
+	upvalue := vm.openUpvalues
+	for upvalue != nil && upvalue.slot > slot {
+		prevUpvalue = upvalue
+		upvalue = upvalue.Next
+	}
+
+	if upvalue != nil && upvalue.slot == slot {
+		return upvalue
+	}
+
+	createdUpvalue := ALLOCATE_OBJ(vm, NewObjUpvalue(&vm.stack[slot], slot))
+	createdUpvalue.Next = upvalue
+
+	if prevUpvalue == nil {
+		vm.openUpvalues = createdUpvalue
+	} else {
+		prevUpvalue.Next = createdUpvalue
+	}
+
+	return createdUpvalue
+}
+
+func (vm *VM) closeUpvalues(last int) {
+	for vm.openUpvalues != nil && vm.openUpvalues.slot >= last {
+		upvalue := vm.openUpvalues
+		upvalue.Closed = *upvalue.Location
+		upvalue.Location = &upvalue.Closed
+		vm.openUpvalues = upvalue.Next
+	}
+}
+
+// run executes instructions until the frame count drops back to baseFrame,
+// leaving the returning frame's result on top of the stack.
+func (vm *VM) run(baseFrame int) InterpretResult {
 	for {
 		if DEBUG_TRACE_EXECUTION {
 			vm.disassembleVM()
@@ -159,32 +521,218 @@ func (vm *VM) Run() InterpretResult {
 			return INTERPRET_COMPILE_ERROR
 		}
 
+		vm.operandWidth = 1
+		if instruction == OP_WIDE || instruction == OP_EXTRA_WIDE {
+			vm.operandWidth = 2
+			if instruction == OP_EXTRA_WIDE {
+				vm.operandWidth = 3
+			}
+			if instruction, err = vm.ReadByte(); err != nil {
+				return INTERPRET_COMPILE_ERROR
+			}
+		}
+
 		switch instruction {
 		case OP_DEFINE_GLOBAL:
-			nameConstant := vm.ReadConstant()
-			nameValue := (*vm.chunk.Constants.Values)[nameConstant].AsString()
+			nameValue := vm.ReadString()
 			vm.globals.Set(nameValue, vm.Peek(0))
 			vm.Pop()
 		case OP_GET_GLOBAL:
-			nameConstant := vm.ReadConstant()
-			nameValue := (*vm.chunk.Constants.Values)[nameConstant].AsString()
+			nameValue := vm.ReadString()
 			value, found := vm.globals.Get(nameValue)
 			if !found {
 				vm.runtimeError("Undefined variable '%s'.", nameValue.Chars)
 				return INTERPRET_RUNTIME_ERROR
 			}
 			vm.Push(value)
+		case OP_SET_GLOBAL:
+			nameValue := vm.ReadString()
+			if vm.globals.Set(nameValue, vm.Peek(0)) {
+				vm.globals.Delete(nameValue)
+				vm.runtimeError("Undefined variable '%s'.", nameValue.Chars)
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_GET_LOCAL:
+			slot := vm.ReadConstant()
+			vm.Push(vm.stack[vm.currentFrame().slots+slot])
+		case OP_SET_LOCAL:
+			slot := vm.ReadConstant()
+			vm.stack[vm.currentFrame().slots+slot] = vm.Peek(0)
+		case OP_JUMP:
+			offset := vm.ReadShort()
+			vm.currentFrame().ip += offset
+		case OP_JUMP_IF_FALSE:
+			offset := vm.ReadShort()
+			if vm.IsFalsy(vm.Peek(0)) {
+				vm.currentFrame().ip += offset
+			}
+		case OP_LOOP:
+			offset := vm.ReadShort()
+			vm.currentFrame().ip -= offset
+		case OP_CALL:
+			argCount := vm.ReadConstant()
+			if !vm.callValue(vm.Peek(argCount), argCount) {
+				return INTERPRET_RUNTIME_ERROR
+			}
 		case OP_POP:
 			vm.Pop()
 		case OP_PRINT:
-			PrintValue(vm.Pop())
-			fmt.Printf("\n")
+			PrintValue(vm.stdout, vm.Pop())
+			fmt.Fprintf(vm.stdout, "\n")
+		case OP_CLASS:
+			vm.Push(NewObjVal(ALLOCATE_OBJ(vm, NewObjClass(vm.ReadString()))))
+		case OP_GET_PROPERTY:
+			if vm.Peek(0).IsHost() {
+				value, err := vm.getHostProperty(vm.Peek(0).AsHost(), vm.ReadString())
+				if err == nil {
+					value, err = vm.adopt(value)
+				}
+				if err != nil {
+					vm.runtimeError("%s", err.Error())
+					return INTERPRET_RUNTIME_ERROR
+				}
+				vm.Pop() // Host object.
+				vm.Push(value)
+				break
+			}
+
+			if !vm.Peek(0).IsInstance() {
+				vm.runtimeError("Only instances have properties.")
+				return INTERPRET_RUNTIME_ERROR
+			}
+
+			instance := vm.Peek(0).AsInstance()
+			name := vm.ReadString()
+
+			if value, found := instance.Fields.Get(name); found {
+				vm.Pop() // Instance.
+				vm.Push(value)
+				break
+			}
+
+			if !vm.bindMethod(instance.Class, name) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_SET_PROPERTY:
+			if vm.Peek(1).IsHost() {
+				if err := vm.setHostProperty(vm.Peek(1).AsHost(), vm.ReadString(), vm.Peek(0)); err != nil {
+					vm.runtimeError("%s", err.Error())
+					return INTERPRET_RUNTIME_ERROR
+				}
+
+				value := vm.Pop()
+				vm.Pop()
+				vm.Push(value)
+				break
+			}
+
+			if !vm.Peek(1).IsInstance() {
+				vm.runtimeError("Only instances have fields.")
+				return INTERPRET_RUNTIME_ERROR
+			}
+
+			instance := vm.Peek(1).AsInstance()
+			instance.Fields.Set(vm.ReadString(), vm.Peek(0))
+			value := vm.Pop()
+			vm.Pop()
+			vm.Push(value)
+		case OP_INHERIT:
+			superclass := vm.Peek(1)
+			if !superclass.IsClass() {
+				vm.runtimeError("Superclass must be a class.")
+				return INTERPRET_RUNTIME_ERROR
+			}
+			if !vm.Peek(0).IsClass() {
+				vm.runtimeError("Only classes can inherit.")
+				return INTERPRET_RUNTIME_ERROR
+			}
+
+			subclass := vm.Peek(0).AsClass()
+			subclass.Methods.SetAll(&superclass.AsClass().Methods)
+			vm.Pop() // Subclass.
+		case OP_GET_SUPER:
+			name := vm.ReadString()
+			if !vm.Peek(0).IsClass() {
+				vm.runtimeError("Superclass must be a class.")
+				return INTERPRET_RUNTIME_ERROR
+			}
+			superclass := vm.Pop().AsClass()
+
+			if !vm.bindMethod(superclass, name) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_SUPER_INVOKE:
+			method := vm.ReadString()
+			argCount, err := vm.ReadByte()
+			if err != nil {
+				return INTERPRET_COMPILE_ERROR
+			}
+			if !vm.Peek(0).IsClass() {
+				vm.runtimeError("Superclass must be a class.")
+				return INTERPRET_RUNTIME_ERROR
+			}
+			superclass := vm.Pop().AsClass()
+			if !vm.invokeFromClass(superclass, method, int(argCount)) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_METHOD:
+			if !vm.defineMethod(vm.ReadString()) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_INVOKE:
+			method := vm.ReadString()
+			argCount, err := vm.ReadByte()
+			if err != nil {
+				return INTERPRET_COMPILE_ERROR
+			}
+			if !vm.invoke(method, int(argCount)) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_CLOSURE:
+			function := (*vm.currentChunk().Constants.Values)[vm.ReadConstant()].AsFunction()
+			closure := ALLOCATE_OBJ(vm, NewObjClosure(function))
+			vm.Push(NewObjVal(closure))
+
+			frame := vm.currentFrame()
+			for i := 0; i < len(closure.Upvalues); i++ {
+				isLocal, err := vm.ReadByte()
+				if err != nil {
+					return INTERPRET_COMPILE_ERROR
+				}
+				index, err := vm.ReadByte()
+				if err != nil {
+					return INTERPRET_COMPILE_ERROR
+				}
+
+				if isLocal == 1 {
+					closure.Upvalues[i] = vm.captureUpvalue(frame.slots + int(index))
+				} else {
+					closure.Upvalues[i] = frame.closure.Upvalues[index]
+				}
+			}
+		case OP_GET_UPVALUE:
+			slot := vm.ReadConstant()
+			vm.Push(*vm.currentFrame().closure.Upvalues[slot].Location)
+		case OP_SET_UPVALUE:
+			slot := vm.ReadConstant()
+			*vm.currentFrame().closure.Upvalues[slot].Location = vm.Peek(0)
+		case OP_CLOSE_UPVALUE:
+			vm.closeUpvalues(vm.stackTop - 1)
+			vm.Pop()
 		case OP_RETURN:
-			return INTERPRET_OK
-		case OP_CONSTANT_LONG:
+			result := vm.Pop()
+			frame := vm.currentFrame()
+			vm.closeUpvalues(frame.slots)
+			vm.frameCount -= 1
+
+			vm.stackTop = frame.slots
+			vm.Push(result)
+			if vm.frameCount == baseFrame {
+				return INTERPRET_OK
+			}
+		case OP_CONSTANT:
 			constant := vm.ReadConstant()
-			constantValue := (*vm.chunk.Constants.Values)[constant]
-			vm.Push(constantValue)
+			vm.Push((*vm.currentChunk().Constants.Values)[constant])
 		case OP_NOT:
 			vm.Push(NewBoolVal(vm.IsFalsy(vm.Pop())))
 		case OP_NIL:
@@ -199,30 +747,34 @@ func (vm *VM) Run() InterpretResult {
 				return INTERPRET_RUNTIME_ERROR
 			}
 
-			vm.Push(NewNumberVal(-*vm.Pop().AsNumber()))
+			vm.Push(NewNumberVal(-vm.Pop().AsNumber()))
 		case OP_EQUAL:
 			b := vm.Pop()
 			a := vm.Pop()
 
 			vm.Push(NewBoolVal(a.IsEqual(b)))
+		case OP_GREATER, OP_LESS:
+			if result := BinaryOp(vm, instruction); result != INTERPRET_OK {
+				return result
+			}
 		case OP_ADD:
 			if vm.Peek(0).IsString() && vm.Peek(1).IsString() {
 				Concatenate(vm)
-			} else {
-				BinaryOp(vm, instruction)
-			}
-		case OP_SUBTRACT:
-			BinaryOp(vm, instruction)
-		case OP_MULTIPLY:
-			BinaryOp(vm, instruction)
-		case OP_DIVIDE:
-			BinaryOp(vm, instruction)
+			} else if result := BinaryOp(vm, instruction); result != INTERPRET_OK {
+				return result
+			}
+		case OP_SUBTRACT, OP_MULTIPLY, OP_DIVIDE:
+			if result := BinaryOp(vm, instruction); result != INTERPRET_OK {
+				return result
+			}
 		}
 	}
 }
 
 func (vm *VM) ResetStack() {
 	vm.stackTop = 0
+	vm.frameCount = 0
+	vm.openUpvalues = nil
 }
 
 func (vm *VM) Push(value Value) {
@@ -240,6 +792,28 @@ func (vm *VM) Peek(distance int) Value {
 }
 
 func (vm *VM) runtimeError(format string, a ...any) {
-	line := vm.chunk.GetLine(vm.ip)
-	fmt.Printf("[line %d] : "+format+"\n", line, a)
+	err := &RuntimeError{Message: fmt.Sprintf(format, a...)}
+
+	for i := vm.frameCount - 1; i >= 0; i-- {
+		frame := &vm.frames[i]
+		function := frame.closure.Function
+		// The ip has already moved past the failing instruction.
+		line := function.Chunk.GetLine(frame.ip - 1)
+		err.Trace = append(err.Trace, StackFrame{
+			Function: functionName(function),
+			Line:     line,
+		})
+	}
+
+	if vm.frameCount > 0 {
+		frame := &vm.frames[vm.frameCount-1]
+		chunk := &frame.closure.Function.Chunk
+		span := chunk.GetSpan(frame.ip - 1)
+
+		err.Line = err.Trace[0].Line
+		err.Column = span.Column
+		err.snippet = renderSpan(chunk.source, span)
+	}
+
+	vm.lastError = err
 }
@@ -0,0 +1,186 @@
+package glox
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// run interprets source and returns what it printed.
+func run(t *testing.T, source string) string {
+	t.Helper()
+
+	var out bytes.Buffer
+	if _, err := Interpret(source, WithStdout(&out), WithStderr(&out)); err != nil {
+		t.Fatalf("Interpret(%q) failed: %v", source, err)
+	}
+	return out.String()
+}
+
+func TestComparisonOperators(t *testing.T) {
+	tests := []struct {
+		left, operator, right string
+		want                  bool
+	}{
+		{"1", "<", "2", true},
+		{"2", "<", "1", false},
+		{"1", "<", "1", false},
+		{"1", "<=", "2", true},
+		{"1", "<=", "1", true},
+		{"2", "<=", "1", false},
+		{"2", ">", "1", true},
+		{"1", ">", "2", false},
+		{"1", ">", "1", false},
+		{"2", ">=", "1", true},
+		{"1", ">=", "1", true},
+		{"1", ">=", "2", false},
+		{"1", "==", "1", true},
+		{"1", "==", "2", false},
+		{"1", "==", "\"1\"", false},
+		{"\"a\"", "==", "\"a\"", true},
+		{"nil", "==", "nil", true},
+		{"1", "!=", "2", true},
+		{"1", "!=", "1", false},
+		{"nil", "!=", "false", true},
+		{"-1", "<", "0", true},
+		{"0.5", ">=", "0.25", true},
+	}
+
+	for _, test := range tests {
+		expression := test.left + " " + test.operator + " " + test.right
+		want := fmt.Sprintln(test.want)
+
+		t.Run(expression, func(t *testing.T) {
+			// Literal operands are folded by the compiler; operands read from
+			// variables are compared by the VM.
+			sources := []string{
+				"print " + expression + ";",
+				"var a = " + test.left + "; var b = " + test.right + "; print a " + test.operator + " b;",
+			}
+			for _, source := range sources {
+				if got := run(t, source); got != want {
+					t.Errorf("%s printed %q, want %q", source, got, want)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkNumericLoop runs a loop of number and boolean arithmetic. Values
+// are unboxed, so calls report 0 allocs/op whatever the iteration count.
+func BenchmarkNumericLoop(b *testing.B) {
+	vm := NewVM()
+	vm.Init()
+	defer vm.Free()
+
+	if _, err := vm.Interpret(`
+fun loop(n) {
+  var sum = 0;
+  var even = true;
+  for (var i = 0; i < n; i = i + 1) {
+    if (even) sum = sum + i * 2; else sum = sum - i / 2;
+    even = !even;
+  }
+  return sum;
+}
+`); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, n := range []int{10, 10000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := vm.Call("loop", NewNumberVal(float64(n))); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// nested returns an expression that adds a to inner depth times, keeping
+// every left operand on the stack until inner is evaluated.
+func nested(depth int, inner string) string {
+	expression := inner
+	for i := 0; i < depth; i++ {
+		expression = "(a + " + expression + ")"
+	}
+	return expression
+}
+
+func TestStackLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"deep expressions in deep recursion",
+			"fun f(n) { var a = 1; if (n == 0) return 0; return " + nested(240, "f(n - 1)") + "; } print f(60);",
+			"",
+		},
+		{
+			"expression too deep for a frame",
+			"var a = 1; print " + nested(300, "a") + ";",
+			"[line 1] Error at 'a': Too many values on the stack in function.",
+		},
+		{
+			"unbounded recursion",
+			"fun f(n) { return f(n + 1) + 1; } f(0);",
+			"Stack overflow.",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			_, err := Interpret(test.source, WithStdout(&out))
+
+			if test.want == "" {
+				if err != nil {
+					t.Fatalf("Interpret failed: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Interpret succeeded, want error %q", test.want)
+			}
+			if first := strings.SplitN(err.Error(), "\n", 2)[0]; first != test.want {
+				t.Errorf("error = %q, want %q", first, test.want)
+			}
+		})
+	}
+}
+
+func TestValuesFromAnotherVM(t *testing.T) {
+	vmA := NewVM()
+	vmA.Init()
+	defer vmA.Free()
+	if _, err := vmA.Interpret(`var s = "h" + "i"; var n = 1; fun f() { return n; }`); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := vmA.GetGlobal("s")
+	f, _ := vmA.GetGlobal("f")
+
+	var out bytes.Buffer
+	vmB := NewVM(WithStdout(&out))
+	vmB.Init()
+	defer vmB.Free()
+
+	// Strings are interned again, so they compare equal to vmB's own.
+	if err := vmB.SetGlobal("k", s); err != nil {
+		t.Fatalf("SetGlobal(string) failed: %v", err)
+	}
+	if _, err := vmB.Interpret(`print k == "hi";`); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "true\n" {
+		t.Errorf("k == \"hi\" printed %q, want \"true\\n\"", got)
+	}
+
+	if err := vmB.SetGlobal("g", f); err == nil || err.Error() != "<fn f> belongs to another VM" {
+		t.Errorf("SetGlobal(closure) = %v, want an error", err)
+	}
+}
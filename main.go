@@ -2,28 +2,57 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/definev/glox/glox"
 )
 
 func Repl() {
+	vm := glox.NewVM()
+	vm.Init()
+	defer vm.Free()
+
 	scanner := bufio.NewScanner(os.Stdin)
+	var source strings.Builder
+
 	fmt.Printf("> ")
 	for scanner.Scan() {
 		text := scanner.Text()
-		if text == "exit" {
+		if source.Len() == 0 && text == "exit" {
 			break
 		}
-		glox.Interpret(text)
+
+		source.WriteString(text)
+		source.WriteString("\n")
+		if glox.NeedsMoreInput(source.String()) {
+			fmt.Printf("... ")
+			continue
+		}
+
+		if _, err := vm.Interpret(source.String()); err != nil {
+			printError(err)
+		}
+		source.Reset()
 		fmt.Printf("\n> ")
 	}
 }
 
 func RunFile(file string) {
 	source := ReadFile(file)
-	result := glox.Interpret(source)
+
+	var result glox.InterpretResult
+	var err error
+	if glox.IsBytecode([]byte(source)) {
+		result, err = glox.InterpretBytecode([]byte(source))
+	} else {
+		result, err = glox.Interpret(source)
+	}
+	if err != nil {
+		printError(err)
+	}
 
 	if result == glox.INTERPRET_COMPILE_ERROR {
 		os.Exit(65)
@@ -36,6 +65,51 @@ func RunFile(file string) {
 	}
 }
 
+func CompileFile(file string, output string) {
+	source := ReadFile(file)
+
+	vm := glox.NewVM()
+	vm.Init()
+	defer vm.Free()
+
+	function, errs := vm.Compile(source)
+	if errs != nil {
+		glox.PrintCompileErrors(os.Stderr, errs)
+		os.Exit(65)
+		return
+	}
+
+	// Never write a file that InterpretBytecode would refuse to run.
+	if err := glox.Verify(&function.Chunk); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(65)
+		return
+	}
+
+	data, err := function.Chunk.MarshalBinary()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(65)
+		return
+	}
+
+	if err := os.WriteFile(output, data, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write file \"%s\".\n", output)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(74)
+		return
+	}
+}
+
+func printError(err error) {
+	var compileErrors glox.CompileErrors
+	if errors.As(err, &compileErrors) {
+		glox.PrintCompileErrors(os.Stderr, compileErrors)
+		return
+	}
+	fmt.Fprintln(os.Stderr, err)
+}
+
 func ReadFile(file string) string {
 	data, err := os.ReadFile(file)
 	if err != nil {
@@ -47,12 +121,20 @@ func ReadFile(file string) string {
 }
 
 func main() {
-	vm := glox.NewVM()
-
-	vm.Init()
-	vm.Interpret(`var a = 1;
-var b = 2 + 3 + a;
-print a + b;
-print "Hello, World!";`)
-	vm.Free()
+	switch len(os.Args) {
+	case 1:
+		Repl()
+	case 2:
+		RunFile(os.Args[1])
+	case 5:
+		if os.Args[1] == "compile" && os.Args[3] == "-o" {
+			CompileFile(os.Args[2], os.Args[4])
+			return
+		}
+		fallthrough
+	default:
+		fmt.Fprintf(os.Stderr, "Usage: glox [path]\n")
+		fmt.Fprintf(os.Stderr, "       glox compile <path> -o <output>\n")
+		os.Exit(64)
+	}
 }